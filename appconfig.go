@@ -3,15 +3,22 @@ package moesifmiddleware
 import (
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"sync"
+
+	moesifapi "github.com/moesif/moesifapi-go"
 )
 
 type AppConfig struct {
 	Mu      sync.RWMutex
 	Updates chan string
 	eTags   [2]string
+	closed  bool
 	config  AppConfigResponse
+	blocked ipBlockList
+	sources appConfigSources
+	cache   *configCache
+	api     moesifapi.API
+	log     Logger
 }
 
 func NewAppConfig() AppConfig {
@@ -27,10 +34,15 @@ func (c *AppConfig) Read() AppConfigResponse {
 	return c.config
 }
 
+// Write replaces the app config, compiling the condition patterns of its regex
+// sampling rules and logging any that are invalid
 func (c *AppConfig) Write(config AppConfigResponse) {
+	config.patterns = make(regexCache)
+	compileSamplingRules(config.patterns, config.RegexConfig, c.logger())
 	c.Mu.Lock()
 	defer c.Mu.Unlock()
 	c.config = config
+	c.blocked = newIPBlockList(config.IPAddressesBlockedByName)
 	c.eTags[1] = c.eTags[0]
 	c.eTags[0] = config.eTag
 }
@@ -41,10 +53,11 @@ func (c *AppConfig) Go() {
 }
 
 func (c *AppConfig) Notify(eTag string) {
+	// hold the read lock while sending so that Close cannot close Updates underneath us
 	c.Mu.RLock()
+	defer c.Mu.RUnlock()
 	e := c.eTags
-	c.Mu.RUnlock()
-	if eTag == "" || eTag == e[0] || eTag == e[1] {
+	if c.closed || eTag == "" || eTag == e[0] || eTag == e[1] {
 		return
 	}
 	select {
@@ -53,22 +66,55 @@ func (c *AppConfig) Notify(eTag string) {
 	}
 }
 
+// Close stops UpdateLoop. Later notifications are ignored.
+func (c *AppConfig) Close() {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.Updates)
+	}
+}
+
+func (c *AppConfig) logger() Logger {
+	if c.log == nil {
+		return defaultLogger
+	}
+	return c.log
+}
+
 func (c *AppConfig) UpdateLoop() {
 	for {
 		eTag, more := <-c.Updates
 		if !more {
 			return
 		}
-		config, err := getAppConfig()
+		config, err := getAppConfig(c.api, c.logger())
 		if err != nil {
-			log.Printf("Failed to get config: %v", err)
+			c.logger().Warn("Failed to get config", "error", err)
 			continue
 		}
-		log.Printf("AppConfig.Notify ETag=%s got /config response ETag=%s", eTag, config.eTag)
-		c.Write(config)
+		c.logger().Info("Got /config response", "notify_etag", eTag, "etag", config.eTag)
+		c.writeRemote(config)
 	}
 }
 
+// blocksIPs reports whether the ip_addresses_blocked_by_name app config blocks any address
+func (c *AppConfig) blocksIPs() bool {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	return !c.blocked.empty()
+}
+
+// BlockedIP returns the name the ip_addresses_blocked_by_name app config blocks
+// ip by, and false if ip is not blocked. ip may be a CIDR range member, an IPv6
+// address, or include a port.
+func (c *AppConfig) BlockedIP(ip string) (string, bool) {
+	c.Mu.RLock()
+	defer c.Mu.RUnlock()
+	return c.blocked.match(ip)
+}
+
 func (c *AppConfig) GetEntityValues(userId, companyId string) (userValues, companyValues []EntityRuleValues) {
 	config := c.Read()
 	return config.UserRules[userId], config.CompanyRules[companyId]
@@ -87,6 +133,7 @@ type AppConfigResponse struct {
 	RegexConfig              []RegexRule                   `json:"regex_config"`
 	BillingConfigJsons       map[string]string             `json:"billing_config_jsons"`
 	eTag                     string
+	patterns                 regexCache
 }
 
 func NewAppConfigResponse() AppConfigResponse {
@@ -113,29 +160,32 @@ type RegexCondition struct {
 	Value string `json:"value"`
 }
 
-func getAppConfig() (config AppConfigResponse, err error) {
+func getAppConfig(api moesifapi.API, logger Logger) (config AppConfigResponse, err error) {
 	config = NewAppConfigResponse()
-	r, err := apiClient.GetAppConfig()
+	r, err := api.GetAppConfig()
 	if err != nil {
-		log.Printf("Application configuration request error: %v", err)
+		logger.Debug("Application configuration request error", "error", err)
 		return
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Application configuration response body read error: %v", err)
+		logger.Debug("Application configuration response body read error", "error", err)
 		return
 	}
 	err = json.Unmarshal(body, &config)
 	if err != nil {
-		log.Printf("Application configuration response body malformed: %v", err)
+		logger.Debug("Application configuration response body malformed", "error", err)
 		return
 	}
 	config.eTag = r.Header.Get("X-Moesif-Config-Etag")
 	return
 }
 
-func getSamplingPercentage(userId string, companyId string) int {
-	c := appConfig.Read()
+// getSamplingPercentage returns the sample rate for an event. A user's sample
+// rate takes precedence over their company's, which takes precedence over the
+// first matching regex sampling rule, which takes precedence over the app's.
+func (a *AppConfig) getSamplingPercentage(lookup *ruleLookup, userId string, companyId string) int {
+	c := a.Read()
 	if userId != "" {
 		if userRate, ok := c.UserSampleRate[userId]; ok {
 			return userRate
@@ -148,5 +198,40 @@ func getSamplingPercentage(userId string, companyId string) int {
 		}
 	}
 
+	for _, rule := range c.RegexConfig {
+		if rule.matches(lookup, c.patterns) {
+			return rule.SampleRate
+		}
+	}
+
 	return c.SampleRate
 }
+
+// samplesByBody reports whether a regex sampling rule has a request body condition
+func (a *AppConfig) samplesByBody() bool {
+	for _, rule := range a.Read().RegexConfig {
+		for _, c := range rule.Conditions {
+			if isBodyPath(c.Path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether all of the rule's conditions match request. The
+// condition paths are those of RequestPathLookup, and the values are regular
+// expressions, compiled in patterns. A rule without conditions matches every
+// request, and a condition with an invalid regular expression does not match.
+func (r RegexRule) matches(lookup *ruleLookup, patterns regexCache) bool {
+	for _, c := range r.Conditions {
+		match, err := patterns.match(c.Value, lookup.lookup(c.Path))
+		if err != nil {
+			lookup.logger.Error("Sampling rule regexp error", "path", c.Path, "regexp", c.Value)
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
@@ -1,18 +1,25 @@
 package moesifmiddleware
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
 const id = ""
 
 func TestGetConfig(t *testing.T) {
-	moesifClient(map[string]interface{}{
-		"Application_Id": id,
-		"Api_Endpoint":   "https://api-dev.moesif.net",
-	})
-	config, err := getAppConfig()
+	options := NewConfig(id)
+	options.ApiEndpoint = "https://api-dev.moesif.net"
+	client, err := startClient(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close(context.Background())
+	config, err := getAppConfig(client.api, client.logger)
 	if err != nil {
 		t.Fail()
 	}
@@ -20,13 +27,102 @@ func TestGetConfig(t *testing.T) {
 }
 
 func TestGetRules(t *testing.T) {
-	moesifClient(map[string]interface{}{
-		"Application_Id": id,
-		"Api_Endpoint":   "https://api-dev.moesif.net",
-	})
-	resp, err := apiClient.GetGovernanceRules()
+	options := NewConfig(id)
+	options.ApiEndpoint = "https://api-dev.moesif.net"
+	client, err := startClient(options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close(context.Background())
+	resp, err := client.api.GetGovernanceRules()
 	if err != nil {
 		t.Fail()
 	}
 	fmt.Printf("%#v\n", resp)
 }
+
+func TestGetSamplingPercentage(t *testing.T) {
+	a := NewAppConfig()
+	config := NewAppConfigResponse()
+	config.SampleRate = 50
+	config.UserSampleRate = map[string]int{"u1": 10}
+	config.CompanySampleRate = map[string]int{"c1": 20}
+	config.RegexConfig = []RegexRule{
+		{Conditions: []RegexCondition{{Path: "request.route", Value: "^/health"}}, SampleRate: 0},
+		{Conditions: []RegexCondition{{Path: "request.verb", Value: "^POST$"}, {Path: "request.route", Value: "^/items"}}, SampleRate: 30},
+		{Conditions: []RegexCondition{{Path: "request.route", Value: "^/items"}}, SampleRate: 40},
+		{Conditions: []RegexCondition{{Path: "request.route", Value: "("}}, SampleRate: 1},
+		{Conditions: []RegexCondition{{Path: "request.body.plan", Value: "^free$"}}, SampleRate: 5},
+	}
+	a.Write(config)
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		userId    string
+		companyId string
+		body      string
+		expected  int
+	}{
+		{"user rate first", "GET", "/health", "u1", "c1", "", 10},
+		{"company rate before regex rules", "GET", "/health", "u2", "c1", "", 20},
+		{"regex rate of zero", "GET", "/health", "u2", "c2", "", 0},
+		{"all conditions match", "POST", "/items", "", "", "", 30},
+		{"first matching rule", "GET", "/items/1", "", "", "", 40},
+		{"body condition", "PUT", "/orders", "", "", `{"plan":"free"}`, 5},
+		{"no rule matches", "PUT", "/orders", "", "", `{"plan":"paid"}`, 50},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		request.Header.Set("Content-Type", "application/json")
+		if rate := a.getSamplingPercentage(newRuleLookup(request, 0, defaultLogger), test.userId, test.companyId); rate != test.expected {
+			t.Errorf("%s: got %d, expected %d", test.name, rate, test.expected)
+		}
+	}
+}
+
+// sampleFreePlan returns a client whose regex sampling rule drops requests with
+// a free plan in the body
+func sampleFreePlan(config *Config) (*Client, *fakeAPI) {
+	c, api := newTestClient(config)
+	appConfig := NewAppConfigResponse()
+	appConfig.RegexConfig = []RegexRule{
+		{Conditions: []RegexCondition{{Path: "request.body.plan", Value: "^free$"}}, SampleRate: 0},
+	}
+	c.appConfig.Write(appConfig)
+	return c, api
+}
+
+func TestMiddlewareSamplesByBody(t *testing.T) {
+	for _, logBody := range []bool{true, false} {
+		config := NewConfig("app")
+		config.LogBody = logBody
+		c, api := sampleFreePlan(config)
+		handler := c.Middleware(echo)
+		serve(handler, "POST", "/orders", `{"plan":"free"}`)
+		if response := serve(handler, "POST", "/orders", `{"plan":"paid"}`); response.Body.String() != `{"plan":"paid"}` {
+			t.Errorf("handler did not see the request body, got %q", response.Body.String())
+		}
+		if events := api.Events(); len(events) != 1 {
+			t.Errorf("LogBody %v: expected only the paid plan to be sampled, got %d events", logBody, len(events))
+		}
+	}
+}
+
+func TestTransportSamplesByBody(t *testing.T) {
+	server := httptest.NewServer(echo)
+	defer server.Close()
+	c, api := sampleFreePlan(NewConfig("app"))
+	client := &http.Client{Transport: c.Transport(nil)}
+	for _, body := range []string{`{"plan":"free"}`, `{"plan":"paid"}`} {
+		response, err := client.Post(server.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	if events := api.Events(); len(events) != 1 {
+		t.Errorf("expected only the paid plan to be sampled, got %d events", len(events))
+	}
+}
@@ -0,0 +1,211 @@
+package moesifmiddleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// BodyParser parses a captured body with the given Content-Type into a value
+// that is masked and logged as JSON. Returning an error logs the body as base64.
+type BodyParser func(body []byte, contentType string) (interface{}, error)
+
+// defaultBodyParsers are used for bodies that are not JSON, keyed like the
+// Body_Parsers option
+var defaultBodyParsers = map[string]BodyParser{
+	"application/x-www-form-urlencoded": parseFormBody,
+	"multipart/form-data":               parseMultipartBody,
+	"text/*":                            parseTextBody,
+	"application/xml":                   parseXMLBody,
+	"text/xml":                          parseXMLBody,
+	"+xml":                              parseXMLBody,
+	"application/x-ndjson":              parseNDJSONBody,
+	"application/ndjson":                parseNDJSONBody,
+	"application/jsonl":                 parseNDJSONBody,
+	"application/x-jsonlines":           parseNDJSONBody,
+}
+
+// lookupBodyParser returns the parser in parsers for mediaType, trying the
+// media type, then its type with a wildcard subtype like "text/*", then its
+// structured syntax suffix like "+xml"
+func lookupBodyParser(parsers map[string]BodyParser, mediaType string) BodyParser {
+	if parser, ok := parsers[mediaType]; ok {
+		return parser
+	}
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		if parser, ok := parsers[mediaType[:i]+"/*"]; ok {
+			return parser
+		}
+	}
+	if i := strings.LastIndex(mediaType, "+"); i >= 0 {
+		if parser, ok := parsers[mediaType[i:]]; ok {
+			return parser
+		}
+	}
+	return nil
+}
+
+// records is a body made of JSON records, like NDJSON, that is masked record by record
+type records []interface{}
+
+var (
+	errInvalidText = errors.New("body is not valid UTF-8")
+	errNoBoundary  = errors.New("multipart body has no boundary")
+)
+
+// parseTextBody logs text bodies as a string
+func parseTextBody(body []byte, contentType string) (interface{}, error) {
+	if !utf8.Valid(body) {
+		return nil, errInvalidText
+	}
+	return string(body), nil
+}
+
+// parseFormBody logs each form field's value, or values if it is repeated
+func parseFormBody(body []byte, contentType string) (interface{}, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	form := make(map[string]interface{}, len(values))
+	for name, fieldValues := range values {
+		for _, value := range fieldValues {
+			addFormValue(form, name, value)
+		}
+	}
+	return form, nil
+}
+
+// addFormValue adds value to form, making a list of the values of repeated fields
+func addFormValue(form map[string]interface{}, name string, value interface{}) {
+	switch existing := form[name].(type) {
+	case nil:
+		form[name] = value
+	case []interface{}:
+		form[name] = append(existing, value)
+	default:
+		form[name] = []interface{}{existing, value}
+	}
+}
+
+// parseMultipartBody logs the value of each form field, and the file name,
+// content type and size of each file rather than its contents
+func parseMultipartBody(body []byte, contentType string) (interface{}, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if params["boundary"] == "" {
+		return nil, errNoBoundary
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	form := make(map[string]interface{})
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// keep the fields read from a truncated body
+			if len(form) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if part.FileName() != "" {
+			size, _ := io.Copy(ioutil.Discard, part)
+			addFormValue(form, part.FormName(), map[string]interface{}{
+				"filename":     part.FileName(),
+				"content_type": part.Header.Get("Content-Type"),
+				"size":         size,
+			})
+		} else {
+			value, _ := ioutil.ReadAll(part)
+			addFormValue(form, part.FormName(), string(value))
+		}
+	}
+	return form, nil
+}
+
+// parseNDJSONBody logs newline delimited JSON as a list of records
+func parseNDJSONBody(body []byte, contentType string) (interface{}, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	var parsed records
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, record)
+	}
+	return parsed, scanner.Err()
+}
+
+// xmlElement is an element being converted by parseXMLBody
+type xmlElement struct {
+	name   string
+	fields map[string]interface{}
+	text   strings.Builder
+}
+
+// value returns the element's text if it has no attributes or child elements,
+// or a map of them with the text under "#text"
+func (e *xmlElement) value() interface{} {
+	text := strings.TrimSpace(e.text.String())
+	if len(e.fields) == 0 {
+		return text
+	}
+	if text != "" {
+		e.fields["#text"] = text
+	}
+	return e.fields
+}
+
+// parseXMLBody logs XML as a map of element names to their text, or to maps of
+// their attributes, prefixed with "@", and child elements. Repeated elements
+// are logged as a list, and namespace prefixes are dropped.
+func parseXMLBody(body []byte, contentType string) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var stack []*xmlElement
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &xmlElement{name: t.Name.Local, fields: make(map[string]interface{})}
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+					e.fields["@"+attr.Name.Local] = attr.Value
+				}
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return map[string]interface{}{e.name: e.value()}, nil
+			}
+			addFormValue(stack[len(stack)-1].fields, e.name, e.value())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package moesifmiddleware
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseBody(t *testing.T) {
+	multipartBody := "--b\r\n" +
+		"Content-Disposition: form-data; name=\"password\"\r\n\r\nsecret\r\n" +
+		"--b\r\n" +
+		"Content-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\nContent-Type: image/png\r\n\r\n12345\r\n" +
+		"--b--\r\n"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    interface{}
+		encoding    string
+	}{
+		{"json", "application/json", `{"password":"secret","a":1}`,
+			map[string]interface{}{"password": "*****", "a": float64(1)}, "json"},
+		{"json with any content type", "text/plain", `{"password":"secret"}`,
+			map[string]interface{}{"password": "*****"}, "json"},
+		{"form", "application/x-www-form-urlencoded", "password=secret&tag=a&tag=b",
+			map[string]interface{}{"password": "*****", "tag": []interface{}{"a", "b"}}, "json"},
+		{"multipart", "multipart/form-data; boundary=b", multipartBody,
+			map[string]interface{}{"password": "*****", "avatar": map[string]interface{}{
+				"filename": "me.png", "content_type": "image/png", "size": int64(5)}}, "json"},
+		{"text", "text/plain; charset=utf-8", "hello world", "hello world", "json"},
+		{"html", "text/html", "<p>hi</p>", "<p>hi</p>", "json"},
+		{"xml", "application/xml", `<user id="1"><password>secret</password><tag>a</tag><tag>b</tag></user>`,
+			map[string]interface{}{"user": map[string]interface{}{"@id": "1", "password": "*****", "tag": []interface{}{"a", "b"}}}, "json"},
+		{"soap", "application/soap+xml",
+			`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope"><soap:Body><Login><password>secret</password></Login></soap:Body></soap:Envelope>`,
+			map[string]interface{}{"Envelope": map[string]interface{}{"Body": map[string]interface{}{"Login": map[string]interface{}{"password": "*****"}}}}, "json"},
+		{"ndjson", "application/x-ndjson", "{\"password\":\"secret\"}\n\n{\"a\":1}\n",
+			records{map[string]interface{}{"password": "*****"}, map[string]interface{}{"a": float64(1)}}, "json"},
+		{"invalid xml", "application/xml", "<user>", "PHVzZXI+", "base64"},
+		{"binary", "application/octet-stream", "\x00\x01", "AAE=", "base64"},
+		{"invalid text", "text/plain", "\xff", "/w==", "base64"},
+	}
+	c, _ := newTestClient(NewConfig("app"))
+	masks := func() []string { return []string{"password"} }
+	for _, test := range tests {
+		body, encoding := c.parseBody([]byte(test.body), test.contentType, masks)
+		if !reflect.DeepEqual(body, test.expected) || encoding != test.encoding {
+			t.Errorf("%s: got %#v as %s, expected %#v as %s", test.name, body, encoding, test.expected, test.encoding)
+		}
+	}
+}
+
+func TestCustomBodyParsers(t *testing.T) {
+	config := NewConfig("app")
+	config.BodyParsers = map[string]BodyParser{
+		"application/json": func(body []byte, contentType string) (interface{}, error) {
+			return map[string]interface{}{"length": len(body)}, nil
+		},
+		"application/*": func(body []byte, contentType string) (interface{}, error) {
+			return nil, errors.New("not parsed")
+		},
+		"+csv": func(body []byte, contentType string) (interface{}, error) {
+			return map[string]interface{}{"password": string(body)}, nil
+		},
+	}
+	c, _ := newTestClient(config)
+	masks := func() []string { return []string{"password"} }
+
+	if body, _ := c.parseBody([]byte(`{}`), "application/json", masks); !reflect.DeepEqual(body, map[string]interface{}{"length": 2}) {
+		t.Errorf("custom parsers should take precedence over JSON, got %#v", body)
+	}
+	if body, encoding := c.parseBody([]byte("<a/>"), "application/xml", masks); encoding != "base64" {
+		t.Errorf("custom parser errors should log base64, got %#v", body)
+	}
+	if body, _ := c.parseBody([]byte("a,b"), "text/vnd.report+csv", masks); !reflect.DeepEqual(body, map[string]interface{}{"password": "*****"}) {
+		t.Errorf("custom parser results should be masked, got %#v", body)
+	}
+}
@@ -0,0 +1,48 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// botTag is the event tag of captured bot traffic
+const botTag = "bot"
+
+// knownBots matches the User-Agent tokens of well-known crawlers, monitors
+// and headless browsers
+var knownBots = regexp.MustCompile(`(?i)googlebot|adsbot-google|mediapartners-google|bingbot|bingpreview|slurp|duckduckbot|baiduspider|yandex(?:bot|images)|sogou|exabot|facebookexternalhit|facebot|ia_archiver|applebot|twitterbot|linkedinbot|pinterestbot|slackbot|discordbot|telegrambot|whatsapp|ahrefsbot|semrushbot|mj12bot|dotbot|petalbot|bytespider|gptbot|ccbot|claudebot|headlesschrome|phantomjs|lighthouse|pingdom|uptimerobot`)
+
+// genericBot matches product names that call themselves bots, either as the
+// first product of the User-Agent or in the "(compatible; name/1.0)" form.
+// Names elsewhere, like phone models in browser User-Agents, do not match.
+var genericBot = regexp.MustCompile(`(?i)(?:^|\(compatible;\s*)([a-z0-9_.-]*(?:bot|crawler|spider|scraper))(?:[/;\s)]|$)`)
+
+// classifyBot returns the lowercase name of the bot userAgent belongs to, or
+// "" if it does not look like a bot
+func classifyBot(userAgent string) string {
+	if name := knownBots.FindString(userAgent); name != "" {
+		return strings.ToLower(name)
+	}
+	if m := genericBot.FindStringSubmatch(userAgent); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+// botName classifies request by its User-Agent, or with the Is_Bot option if it
+// is set. Requests Is_Bot reports as bots that have no known User-Agent are
+// classified as "custom".
+func (c *Client) botName(request *http.Request) string {
+	name := classifyBot(request.UserAgent())
+	if c.config.IsBot == nil {
+		return name
+	}
+	if !c.config.IsBot(request) {
+		return ""
+	}
+	if name == "" {
+		name = "custom"
+	}
+	return name
+}
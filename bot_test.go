@@ -0,0 +1,143 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+func TestClassifyBot(t *testing.T) {
+	for userAgent, expected := range map[string]string{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":    "googlebot",
+		"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)":     "bingbot",
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)":   "facebookexternalhit",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 HeadlessChrome/120.0.0.0": "headlesschrome",
+		"Acme-Crawler/1.0":  "acme-crawler",
+		"my_status_bot 2.3": "my_status_bot",
+		"Mozilla/5.0 (compatible; AcmeBot/1.0; +http://acme.example/bot)":                      "acmebot",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 Safari/605.1.15": "",
+		"curl/8.4.0": "",
+		"":           "",
+	} {
+		if name := classifyBot(userAgent); name != expected {
+			t.Errorf("%q: got %q, expected %q", userAgent, name, expected)
+		}
+	}
+}
+
+func TestClassifyBotBrowsers(t *testing.T) {
+	for _, userAgent := range []string{
+		"Mozilla/5.0 (Linux; Android 9; CUBOT P30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/74.0.3729.136 Mobile Safari/537.36",
+		"Mozilla/5.0 (Linux; Android 10; Cubot X30 Build/QP1A.190711.020) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.120 Mobile Safari/537.36",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:127.0) Gecko/20100101 Firefox/127.0",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+	} {
+		if name := classifyBot(userAgent); name != "" {
+			t.Errorf("%q classified as bot %q", userAgent, name)
+		}
+	}
+}
+
+func serveAs(handler http.Handler, userAgent string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/items", nil)
+	request.Header.Set("User-Agent", userAgent)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+func TestBotTraffic(t *testing.T) {
+	tests := []struct {
+		name      string
+		block     bool
+		blockReqs bool
+		isBot     func(*http.Request) bool
+		userAgent string
+		status    int
+		bot       string
+	}{
+		{"tagged", false, false, nil, "Googlebot/2.1", http.StatusOK, "googlebot"},
+		{"not a bot", true, true, nil, "Mozilla/5.0", http.StatusOK, ""},
+		{"not captured", true, false, nil, "Googlebot/2.1", http.StatusOK, "skipped"},
+		{"blocked", true, true, nil, "Googlebot/2.1", http.StatusForbidden, "skipped"},
+		{"Is_Bot classifies", false, false, func(*http.Request) bool { return true }, "Mozilla/5.0", http.StatusOK, "custom"},
+		{"Is_Bot overrides User-Agent", true, true, func(*http.Request) bool { return false }, "Googlebot/2.1", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.IsBot = test.isBot
+		config.BlockBotRequests = test.blockReqs
+		c, api := newTestClient(config)
+		appConfig := NewAppConfigResponse()
+		appConfig.BlockBotTraffic = test.block
+		c.appConfig.Write(appConfig)
+
+		served := false
+		response := serveAs(c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			served = true
+		})), test.userAgent)
+		if response.Code != test.status || served != (test.status == http.StatusOK) {
+			t.Errorf("%s: got status %d, served=%v", test.name, response.Code, served)
+		}
+
+		events := api.Events()
+		if test.bot == "skipped" {
+			if len(events) != 0 {
+				t.Errorf("%s: expected no events, got %d", test.name, len(events))
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: expected one event, got %d", test.name, len(events))
+		}
+		bot, _ := captureInfo(events[0])["bot"].(string)
+		tagged := events[0].Tags != nil && *events[0].Tags == botTag
+		if bot != test.bot || tagged != (test.bot != "") {
+			t.Errorf("%s: got bot %q, tagged=%v", test.name, bot, tagged)
+		}
+	}
+}
+
+func TestUncapturedBotTrafficIsStillEnforced(t *testing.T) {
+	block := ruleWith("request.route", "^/admin")
+	block.ID = "block-admin"
+	block.Type = "regex"
+	block.Block = true
+	block.ResponseOverrides.Status = http.StatusUnauthorized
+
+	c, api := newTestClient(NewConfig("app"))
+	appConfig := NewAppConfigResponse()
+	appConfig.BlockBotTraffic = true
+	appConfig.IPAddressesBlockedByName = map[string]string{"192.0.2.0/24": "scrapers"}
+	c.appConfig.Write(appConfig)
+	rules := NewGovernanceRulesConfig()
+	rules.Regex = []moesifapi.GovernanceRule{block}
+	c.governanceRules.Write(rules)
+	handler := c.Middleware(echo)
+
+	for _, test := range []struct {
+		target     string
+		remoteAddr string
+		status     int
+	}{
+		{"/items", "192.0.2.1:1234", http.StatusForbidden},
+		{"/admin", "198.51.100.1:1234", http.StatusUnauthorized},
+		{"/items", "198.51.100.1:1234", http.StatusOK},
+	} {
+		request := httptest.NewRequest("GET", test.target, nil)
+		request.RemoteAddr = test.remoteAddr
+		request.Header.Set("User-Agent", "Googlebot/2.1")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("%s from %s: got %d, expected %d", test.target, test.remoteAddr, response.Code, test.status)
+		}
+	}
+	if events := api.Events(); len(events) != 0 {
+		t.Errorf("expected bot traffic not to be captured, got %d events", len(events))
+	}
+}
@@ -0,0 +1,87 @@
+package moesifmiddleware
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// captureBuffer keeps the first max bytes written to it for logging and
+// counts the rest. A max of 0 keeps everything.
+type captureBuffer struct {
+	buf  []byte
+	max  int
+	size int64 // bytes written, including those not kept
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	keep := len(p)
+	if b.max > 0 && b.max-len(b.buf) < keep {
+		keep = b.max - len(b.buf)
+	}
+	b.buf = append(b.buf, p[:keep]...)
+	return len(p), nil
+}
+
+// bytes returns the captured bytes, or nil for a nil captureBuffer
+func (b *captureBuffer) bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.buf
+}
+
+// truncated reports whether b holds less than the whole body
+func (b *captureBuffer) truncated(declared int64) bool {
+	return b != nil && int64(len(b.buf)) < bodySize(b, declared)
+}
+
+// captureBody reads the first max bytes of r, or all of r if max is 0, into a
+// captureBuffer. The returned reader yields all of r, and counts the bytes
+// after the first max in the captureBuffer as they are read.
+func captureBody(r io.Reader, max int) (io.Reader, *captureBuffer, error) {
+	captured := &captureBuffer{max: max}
+	if max <= 0 {
+		p, err := ioutil.ReadAll(r)
+		captured.buf = p
+		captured.size = int64(len(p))
+		return bytes.NewReader(p), captured, err
+	}
+	// read one byte more than is kept to tell whether the body is truncated
+	p, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	n := len(p)
+	if n > max {
+		n = max
+	}
+	captured.buf = p[:n:n]
+	captured.size = int64(len(p))
+	return io.MultiReader(bytes.NewReader(p), io.TeeReader(r, captured)), captured, err
+}
+
+// bodySize returns the size of the body captured in b, which is its declared
+// length if the body was not read to the end
+func bodySize(b *captureBuffer, declared int64) int64 {
+	if b == nil {
+		return 0
+	}
+	if declared > b.size {
+		return declared
+	}
+	return b.size
+}
+
+// addTruncation records under info that the body named name was truncated
+// for logging, or not read to the end, with its size
+func addTruncation(info map[string]interface{}, name string, b *captureBuffer, declared int64) {
+	if b.truncated(declared) {
+		info[name+"_body_truncated"] = true
+		info[name+"_body_size"] = bodySize(b, declared)
+	}
+}
+
+// readCloser is a body that reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -1,10 +1,9 @@
 package moesifmiddleware
 
 import (
-	"bytes"
 	"context"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -15,9 +14,11 @@ type Transport struct {
 	Transport   http.RoundTripper
 	LogRequest  func(req *http.Request)
 	LogResponse func(resp *http.Response)
+	client      *Client
 }
 
 // The default logging transport that wraps http.DefaultTransport.
+// It captures outgoing calls with the client started by StartCaptureOutgoing.
 var DefaultTransport = &Transport{
 	Transport: http.DefaultTransport,
 }
@@ -44,25 +45,29 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 	// Outgoing Response Time
 	outgoingRspTime := time.Now().UTC()
 
+	c := t.client
+	if c == nil {
+		c = currentDefaultClient()
+	}
+	if c == nil {
+		return response, err
+	}
+
 	// Skip capture outgoing event
 	shouldSkipOutgoing := false
-	if _, found := moesifOption["Should_Skip_Outgoing"]; found {
-		shouldSkipOutgoing = moesifOption["Should_Skip_Outgoing"].(func(*http.Request, *http.Response) bool)(request, response)
+	if c.config.ShouldSkipOutgoing != nil {
+		shouldSkipOutgoing = c.config.ShouldSkipOutgoing(request, response)
 	}
 
 	// Skip / Send event to moesif
 	if shouldSkipOutgoing {
-		if debug {
-			log.Printf("Skip sending the outgoing event to Moesif")
-		}
+		c.logger.Debug("Skip sending the outgoing event to Moesif", "direction", "Outgoing")
 	} else {
 
 		// Check if the event is to Moesif
 		if !(strings.Contains(request.URL.String(), "moesif.net")) {
 
-			if debug {
-				log.Printf("Sending the outgoing event to Moesif")
-			}
+			c.logger.Debug("Sending the outgoing event to Moesif", "direction", "Outgoing")
 
 			// Get Request Body
 			var (
@@ -71,29 +76,35 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 				reqContentLength *int64
 			)
 
-			if logBodyOutgoing && request.Body != nil {
+			// Record bodies truncated to Max_Request_Body_Size and Max_Response_Body_Size
+			captureInfo := make(map[string]interface{})
+
+			// The transport has closed the request body, so regex sampling rules
+			// match the body captured below, if any
+			lookup := newRuleLookup(request, c.config.MaxRequestBodySize, c.logger)
+			lookup.setBody(nil)
+
+			if c.config.LogBodyOutgoing && request.Body != nil && request.GetBody != nil {
 				copyBody, err := request.GetBody()
 				if err != nil {
-					if debug {
-						log.Printf("Error while getting the outgoing request body: %s.\n", err.Error())
+					c.logger.Debug("Error while getting the outgoing request body", "direction", "Outgoing", "error", err)
+				} else {
+					// Read the request body, counting the bytes after Max_Request_Body_Size
+					body, reqBody, reqBodyErr := captureBody(copyBody, c.config.MaxRequestBodySize)
+					if reqBodyErr == nil {
+						_, reqBodyErr = io.Copy(ioutil.Discard, body)
 					}
-				}
-
-				// Read the request body
-				readReqBody, reqBodyErr := ioutil.ReadAll(copyBody)
-				if reqBodyErr != nil {
-					if debug {
-						log.Printf("Error while reading outgoing request body: %s.\n", reqBodyErr.Error())
+					copyBody.Close()
+					if reqBodyErr != nil {
+						c.logger.Debug("Error while reading outgoing request body", "direction", "Outgoing", "error", reqBodyErr)
 					}
-				}
-				reqContentLength = getContentLength(request.Header, readReqBody)
-
-				// Parse the request Body
-				outgoingReqBody, reqEncoding = parseBody(readReqBody, "Request_Body_Masks")
-
-				// Return io.ReadCloser while making sure a Close() is available for request body
-				request.Body = ioutil.NopCloser(bytes.NewBuffer(readReqBody))
+					reqContentLength = c.getContentLength(request.Header, bodySize(reqBody, request.ContentLength))
+					addTruncation(captureInfo, "request", reqBody, request.ContentLength)
+					lookup.setBody(reqBody.bytes())
 
+					// Parse the request Body
+					outgoingReqBody, reqEncoding = c.parseEncodedBody(reqBody.bytes(), reqBody.truncated(request.ContentLength), request.Header, c.config.MaxRequestBodySize, c.config.RequestBodyMasks, captureInfo, "request")
+				}
 			}
 
 			// Get Response Body
@@ -103,57 +114,55 @@ func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
 				respContentLength *int64
 			)
 
-			if logBodyOutgoing && response.Body != nil {
-				// Read the response body
-				readRespBody, err := ioutil.ReadAll(response.Body)
+			if c.config.LogBodyOutgoing && response.Body != nil {
+				// Read the first Max_Response_Body_Size bytes of the response body
+				body, respBody, err := captureBody(response.Body, c.config.MaxResponseBodySize)
 				if err != nil {
-					if debug {
-						log.Printf("Error while reading outgoing response body: %s.\n", err.Error())
-					}
+					c.logger.Debug("Error while reading outgoing response body", "direction", "Outgoing", "error", err)
 				}
-				respContentLength = getContentLength(response.Header, readRespBody)
+				respContentLength = c.getContentLength(response.Header, bodySize(respBody, response.ContentLength))
+				addTruncation(captureInfo, "response", respBody, response.ContentLength)
 
 				// Parse the response Body
-				outgoingRespBody, respEncoding = parseBody(readRespBody, "Response_Body_Masks")
+				outgoingRespBody, respEncoding = c.parseEncodedBody(respBody.bytes(), respBody.truncated(response.ContentLength), response.Header, c.config.MaxResponseBodySize, c.config.ResponseBodyMasks, captureInfo, "response")
 
-				// Return io.ReadCloser while making sure a Close() is available for response body
-				response.Body = ioutil.NopCloser(bytes.NewBuffer(readRespBody))
+				// The caller reads the captured bytes followed by the rest of the response body
+				response.Body = readCloser{body, response.Body}
 			}
 
 			// Get Outgoing Event Metadata
 			var metadataOutgoing map[string]interface{} = nil
-			if _, found := moesifOption["Get_Metadata_Outgoing"]; found {
-				metadataOutgoing = moesifOption["Get_Metadata_Outgoing"].(func(*http.Request, *http.Response) map[string]interface{})(request, response)
+			if c.config.GetMetadataOutgoing != nil {
+				metadataOutgoing = c.config.GetMetadataOutgoing(request, response)
 			}
+			metadataOutgoing = addCaptureMetadata(metadataOutgoing, captureInfo)
 
 			// Get Outgoing User
-			userIdOutgoing := getConfigStringValuesForOutgoingEvent("Identify_User_Outgoing", request, response)
+			userIdOutgoing := getConfigStringValuesForOutgoingEvent(c.config.IdentifyUserOutgoing, request, response)
 
 			// Get Outgoing Company
-			companyIdOutgoing := getConfigStringValuesForOutgoingEvent("Identify_Company_Outgoing", request, response)
+			companyIdOutgoing := getConfigStringValuesForOutgoingEvent(c.config.IdentifyCompanyOutgoing, request, response)
 
 			// Get Outgoing Session Token
-			sessionTokenOutgoing := getConfigStringValuesForOutgoingEvent("Get_Session_Token_Outgoing", request, response)
+			sessionTokenOutgoing := getConfigStringValuesForOutgoingEvent(c.config.GetSessionTokenOutgoing, request, response)
 
 			direction := "Outgoing"
 
 			// Mask Request Header
 			var requestHeader map[string]interface{}
-			requestHeader = maskHeaders(HeaderToMap(request.Header), "Request_Header_Masks")
+			requestHeader = c.maskHeaders(HeaderToMap(request.Header), c.config.RequestHeaderMasks)
 
 			// Mask Response Header
 			var responseHeader map[string]interface{}
-			responseHeader = maskHeaders(HeaderToMap(response.Header), "Response_Header_Masks")
+			responseHeader = c.maskHeaders(HeaderToMap(response.Header), c.config.ResponseHeaderMasks)
 
 			// Send Event To Moesif
-			sendMoesifAsync(request, outgoingReqTime, requestHeader, nil, outgoingReqBody, &reqEncoding, reqContentLength,
+			c.sendMoesifAsync(request, lookup, outgoingReqTime, requestHeader, nil, outgoingReqBody, &reqEncoding, reqContentLength,
 				outgoingRspTime, response.StatusCode, responseHeader, outgoingRespBody, &respEncoding, respContentLength,
-				userIdOutgoing, companyIdOutgoing, &sessionTokenOutgoing, metadataOutgoing, &direction)
+				userIdOutgoing, companyIdOutgoing, &sessionTokenOutgoing, nil, metadataOutgoing, &direction)
 
 		} else {
-			if debug {
-				log.Println("Request Skipped since it is Moesif Event")
-			}
+			c.logger.Debug("Request skipped since it is a Moesif event", "direction", "Outgoing")
 		}
 	}
 
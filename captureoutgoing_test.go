@@ -0,0 +1,47 @@
+package moesifmiddleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransportMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.(http.Flusher).Flush() // send the response without a Content-Length
+		rw.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	config := NewConfig("app")
+	config.MaxRequestBodySize = 2
+	config.MaxResponseBodySize = 3
+	c, api := newTestClient(config)
+	client := &http.Client{Transport: c.Transport(nil)}
+
+	response, err := client.Post(server.URL, "text/plain", strings.NewReader("abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "0123456789" {
+		t.Errorf("caller did not see the whole response body, got %q", body)
+	}
+
+	events := api.Events()
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	e := events[0]
+	// the truncated text body still parses, the unparsed response body is dropped
+	if *e.Request.Body != "ab" || e.Response.Body != nil {
+		t.Errorf("expected a truncated text body and no response body, got %v and %v", *e.Request.Body, e.Response.Body)
+	}
+	info := captureInfo(e)
+	if info["request_body_size"] != int64(6) || info["response_body_truncated"] != true {
+		t.Errorf("unexpected capture metadata %v", info)
+	}
+}
@@ -0,0 +1,491 @@
+package moesifmiddleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	moesifapi "github.com/moesif/moesifapi-go"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// Client captures API calls and sends them to Moesif for one Config. Each
+// Client owns its AppConfig and GovernanceRules, so a process can run several
+// middlewares with different options. Clients share one Moesif API client.
+type Client struct {
+	config          *Config
+	api             moesifapi.API
+	appConfig       AppConfig
+	governanceRules GovernanceRules
+	logger          Logger
+	pii             *piiScrubber
+	local           *localFiles
+	trustedProxies  ipBlockList
+	sharedApi       bool // api is the process-wide client from acquireApi
+
+	forwardingWarning sync.Once // warns that IP blocks ignore X-Forwarded-For
+
+	mu      sync.RWMutex // held for writing to close, for reading to queue
+	closed  bool
+	apiMu   sync.Mutex // held to flush or stop the Moesif API client
+	stopped bool       // set once Close has stopped the Moesif API client
+	queued  int64      // events, users, companies and subscriptions accepted by the queue
+	flushed int64      // value of queued when the last completed flush started
+	dropped int64      // items rejected by the queue, queued after Close, or not flushed by Close
+}
+
+// moesifapi-go keeps its settings, such as the Application Id, API endpoint
+// and batch size, in package state that its workers read while sending to
+// Moesif. So that starting a client cannot change them under a running one,
+// every client in a process shares one Moesif API client, started with the
+// settings of the first.
+var apiIdentity struct {
+	sync.Mutex
+	settings apiSettings
+	api      moesifapi.API
+	refs     int // clients using api
+}
+
+// apiClients are the clients notified of the config and rules tags the shared
+// Moesif API client receives. It has its own lock because the tags arrive
+// while the API client flushes.
+var apiClients struct {
+	sync.Mutex
+	clients []*Client
+}
+
+// apiSettings are the options the shared Moesif API client is started with
+type apiSettings struct {
+	applicationId      string
+	apiEndpoint        string
+	eventQueueSize     int
+	batchSize          int
+	timerWakeUpSeconds int
+}
+
+func newApiSettings(config *Config) apiSettings {
+	return apiSettings{
+		applicationId:      config.ApplicationId,
+		apiEndpoint:        config.ApiEndpoint,
+		eventQueueSize:     config.EventQueueSize,
+		batchSize:          config.BatchSize,
+		timerWakeUpSeconds: config.TimerWakeUpSeconds,
+	}
+}
+
+var (
+	errApiIdentityConflict = errors.New("moesif: Application_Id, Api_Endpoint, Event_Queue_Size, Batch_Size and Timer_Wake_Up_Seconds must be the same for every client in a process")
+	errClientClosed        = errors.New("moesif: client is closed")
+)
+
+// acquireApi returns the shared Moesif API client, starting it with the
+// settings of config if no client is running
+func acquireApi(config *Config) (moesifapi.API, error) {
+	apiIdentity.Lock()
+	defer apiIdentity.Unlock()
+	settings := newApiSettings(config)
+	if apiIdentity.refs > 0 {
+		if apiIdentity.settings != settings {
+			return nil, errApiIdentityConflict
+		}
+		apiIdentity.refs++
+		return apiIdentity.api, nil
+	}
+	api := moesifapi.NewAPI(settings.applicationId, &settings.apiEndpoint, settings.eventQueueSize, settings.batchSize, settings.timerWakeUpSeconds)
+	api.SetEventsHeaderCallback("X-Moesif-Config-ETag", func(eTag string) {
+		notifyApiClients(func(c *Client) { c.appConfig.Notify(eTag) })
+	})
+	api.SetEventsHeaderCallback("X-Moesif-Rules-Tag", func(eTag string) {
+		notifyApiClients(func(c *Client) { c.governanceRules.Notify(eTag) })
+	})
+	apiIdentity.settings = settings
+	apiIdentity.api = api
+	apiIdentity.refs = 1
+	return api, nil
+}
+
+// releaseApi stops notifying c and drops its reference to the shared Moesif
+// API client, stopping it if c was the last client using it. The identity
+// stays held while it stops, so no client can start a new one until then.
+func releaseApi(c *Client) {
+	apiClients.Lock()
+	for i, client := range apiClients.clients {
+		if client == c {
+			apiClients.clients = append(apiClients.clients[:i], apiClients.clients[i+1:]...)
+			break
+		}
+	}
+	apiClients.Unlock()
+
+	apiIdentity.Lock()
+	defer apiIdentity.Unlock()
+	apiIdentity.refs--
+	if apiIdentity.refs > 0 {
+		return
+	}
+	apiIdentity.api.Close()
+	apiIdentity.api = nil
+}
+
+// notifyApiClients calls notify for every client using the shared Moesif API client
+func notifyApiClients(notify func(*Client)) {
+	apiClients.Lock()
+	clients := append([]*Client(nil), apiClients.clients...)
+	apiClients.Unlock()
+	for _, c := range clients {
+		notify(c)
+	}
+}
+
+// NewClient validates config and starts a Client using a copy of it.
+// Clients may differ in every option except Application_Id, Api_Endpoint,
+// Event_Queue_Size, Batch_Size and Timer_Wake_Up_Seconds, because all clients
+// in a process send through one moesifapi-go client. NewClient returns
+// errApiIdentityConflict if they differ from a running client.
+func NewClient(config *Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return startClient(config)
+}
+
+// startClient starts a Client with the shared Moesif API client without
+// validating config
+func startClient(config *Config) (*Client, error) {
+	api, err := acquireApi(config)
+	if err != nil {
+		return nil, err
+	}
+	c := newClient(config, api, true)
+	c.sharedApi = true
+	apiClients.Lock()
+	apiClients.clients = append(apiClients.clients, c)
+	apiClients.Unlock()
+	return c, nil
+}
+
+// newClient starts a Client sending to api without validating config. If
+// update is false, the client does not fetch app config and governance rules
+// from Moesif.
+func newClient(config *Config, api moesifapi.API, update bool) *Client {
+	c := &Client{
+		appConfig:       NewAppConfig(),
+		governanceRules: NewGovernanceRules(),
+	}
+	copied := *config
+	c.config = &copied
+	c.logger = newLogger(config)
+	c.pii = newPIIScrubber(config)
+	c.trustedProxies = newTrustedProxies(config.TrustedProxies)
+
+	c.api = api
+	c.appConfig.api = c.api
+	c.appConfig.log = c.logger
+	c.governanceRules.api = c.api
+	c.governanceRules.log = c.logger
+
+	// load the app config and rules cached by an earlier run before the first
+	// request, so that they apply until fresh ones are fetched
+	cache := newConfigCache(config, c.logger)
+	c.appConfig.cache = cache
+	c.governanceRules.cache = cache
+	c.loadConfigCache()
+
+	// load local config files before the first request, and watch them for changes
+	c.local = c.loadLocalFiles()
+	if c.local != nil && config.ConfigFileReloadSeconds >= 0 {
+		interval := defaultLocalConfigReload
+		if config.ConfigFileReloadSeconds > 0 {
+			interval = time.Duration(config.ConfigFileReloadSeconds) * time.Second
+		}
+		go c.local.watch(interval)
+	}
+
+	if !update {
+		return c
+	}
+	// run goroutine to check end point for updates, unless replaced by a local file
+	if !config.ReplaceRemoteConfig || config.AppConfigFile == "" {
+		c.appConfig.Go()
+	}
+	// run goroutine to check end point for updates, unless replaced by a local file
+	if !config.ReplaceRemoteConfig || config.GovernanceRulesFile == "" {
+		c.governanceRules.Go()
+	}
+	return c
+}
+
+// loadConfigCache writes the cached app config and governance rules, if they
+// are not older than Config_Cache_Max_Age
+func (c *Client) loadConfigCache() {
+	if config, ok := c.appConfig.cache.loadAppConfig(); ok {
+		c.logger.Info("Loaded cached app config", "etag", config.eTag)
+		c.appConfig.setRemote(config)
+	}
+	if rules, eTag, ok := c.governanceRules.cache.loadRules(); ok {
+		c.logger.Info("Loaded cached governance rules", "etag", eTag, "rules", len(rules))
+		c.governanceRules.setRemote(rules, eTag)
+	}
+}
+
+// Default client used by the package level functions
+var (
+	defaultClientMu sync.Mutex
+	defaultClient   *Client
+)
+
+// getDefaultClient returns the default client, starting it with the config
+// returned by newConfig if this is the first use. The default client is not
+// started if it conflicts with a running client, see NewClient.
+func getDefaultClient(newConfig func() *Config) (*Client, error) {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	if defaultClient == nil {
+		config := newConfig()
+		c, err := startClient(config)
+		if err != nil {
+			newLogger(config).Error("Not starting the default client, it conflicts with another client", "error", err)
+			return nil, err
+		}
+		defaultClient = c
+	}
+	return defaultClient, nil
+}
+
+func currentDefaultClient() *Client {
+	defaultClientMu.Lock()
+	defer defaultClientMu.Unlock()
+	return defaultClient
+}
+
+// queue adds n items to the Moesif API client's queue with add, counting them
+// as queued or dropped
+func (c *Client) queue(n int, add func() error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		atomic.AddInt64(&c.dropped, int64(n))
+		return errClientClosed
+	}
+	if err := add(); err != nil {
+		atomic.AddInt64(&c.dropped, int64(n))
+		return err
+	}
+	atomic.AddInt64(&c.queued, int64(n))
+	return nil
+}
+
+// Flush sends everything queued so far to Moesif, returning ctx.Err() if ctx
+// is done first. The flush continues in the background in that case.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mu.RLock()
+	closed := c.closed
+	c.mu.RUnlock()
+	if closed {
+		return errClientClosed
+	}
+	return c.wait(ctx, func() {
+		// the Moesif API client cannot flush once Close has stopped it
+		c.apiMu.Lock()
+		defer c.apiMu.Unlock()
+		if !c.stopped {
+			c.api.Flush()
+		}
+	})
+}
+
+// wait runs flush in the background and waits for it or ctx, recording what
+// was queued before it started as flushed if it completes
+func (c *Client) wait(ctx context.Context, flush func()) error {
+	queued := atomic.LoadInt64(&c.queued)
+	done := make(chan struct{})
+	go func() {
+		flush()
+		for {
+			flushed := atomic.LoadInt64(&c.flushed)
+			if flushed >= queued || atomic.CompareAndSwapInt64(&c.flushed, flushed, queued) {
+				break
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the AppConfig and GovernanceRules update loops, flushes the
+// queue and stops the Moesif API client once no other client uses it. Events
+// captured after Close are dropped. If ctx is done before the queue is
+// flushed, Close returns ctx.Err() and counts everything queued since the last
+// completed flush as dropped. Close returns the number of events, users,
+// companies and subscriptions the client dropped over its lifetime.
+func (c *Client) Close(ctx context.Context) (dropped int64, err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return atomic.LoadInt64(&c.dropped), errClientClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.appConfig.Close()
+	c.governanceRules.Close()
+	c.local.close()
+
+	// an in-flight Flush finishes before the Moesif API client is stopped. The
+	// client keeps its reference to the shared API client until its final
+	// flush is done, even if ctx is done first.
+	err = c.wait(ctx, func() {
+		c.apiMu.Lock()
+		defer c.apiMu.Unlock()
+		c.stopped = true
+		if !c.sharedApi {
+			c.api.Close()
+			return
+		}
+		c.api.Flush()
+		releaseApi(c)
+	})
+	if err != nil {
+		atomic.AddInt64(&c.dropped, atomic.LoadInt64(&c.queued)-atomic.LoadInt64(&c.flushed))
+	}
+	return atomic.LoadInt64(&c.dropped), err
+}
+
+// reportError passes err to the On_Error callback, or logs it if there is none
+func (c *Client) reportError(err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+		return
+	}
+	c.logger.Error("Error while adding to the Moesif queue", "error", err)
+}
+
+// Dropped returns the number of events, users, companies and subscriptions
+// that could not be queued, were captured after Close, or were not flushed by Close
+func (c *Client) Dropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// Dropped returns the default client's dropped count, see Client.Dropped
+func Dropped() int64 {
+	if c := currentDefaultClient(); c != nil {
+		return c.Dropped()
+	}
+	return 0
+}
+
+// Flush flushes the default client, see Client.Flush
+func Flush(ctx context.Context) error {
+	if c := currentDefaultClient(); c != nil {
+		return c.Flush(ctx)
+	}
+	return nil
+}
+
+// Close closes the default client, see Client.Close. The package level
+// functions start a new default client if they are used afterwards.
+func Close(ctx context.Context) (dropped int64, err error) {
+	defaultClientMu.Lock()
+	c := defaultClient
+	defaultClient = nil
+	defaultClientMu.Unlock()
+	if c == nil {
+		return 0, nil
+	}
+	return c.Close(ctx)
+}
+
+// Transport returns an http.RoundTripper that captures outgoing calls made
+// through base, or through http.DefaultTransport if base is nil
+func (c *Client) Transport(base http.RoundTripper) *Transport {
+	return &Transport{
+		Transport: base,
+		client:    c,
+	}
+}
+
+// Update User
+func (c *Client) UpdateUser(user *models.UserModel) error {
+	// Add event to the queue
+	errUpdateUser := c.queue(1, func() error { return c.api.QueueUser(user) })
+	// Log the message
+	if errUpdateUser != nil {
+		c.reportError(errUpdateUser)
+		return errUpdateUser
+	}
+	c.logger.Debug("Update User successfully added to the queue")
+	return nil
+}
+
+// Update Users Batch
+func (c *Client) UpdateUsersBatch(users []*models.UserModel) error {
+	// Add event to the queue
+	errUpdateUserBatch := c.queue(len(users), func() error { return c.api.QueueUsers(users) })
+	// Log the message
+	if errUpdateUserBatch != nil {
+		c.reportError(errUpdateUserBatch)
+		return errUpdateUserBatch
+	}
+	c.logger.Debug("Updated Users successfully added to the queue")
+	return nil
+}
+
+// Update Company
+func (c *Client) UpdateCompany(company *models.CompanyModel) error {
+	// Add event to the queue
+	errUpdateCompany := c.queue(1, func() error { return c.api.QueueCompany(company) })
+	// Log the message
+	if errUpdateCompany != nil {
+		c.reportError(errUpdateCompany)
+		return errUpdateCompany
+	}
+	c.logger.Debug("Update Company successfully added to the queue")
+	return nil
+}
+
+// Update Companies Batch
+func (c *Client) UpdateCompaniesBatch(companies []*models.CompanyModel) error {
+	// Add event to the queue
+	errUpdateCompaniesBatch := c.queue(len(companies), func() error { return c.api.QueueCompanies(companies) })
+	// Log the message
+	if errUpdateCompaniesBatch != nil {
+		c.reportError(errUpdateCompaniesBatch)
+		return errUpdateCompaniesBatch
+	}
+	c.logger.Debug("Updated companies successfully added to the queue")
+	return nil
+}
+
+// Update Subscription
+func (c *Client) UpdateSubscription(subscription *models.SubscriptionModel) error {
+	// Add event to the queue
+	errUpdateSubscription := c.queue(1, func() error { return c.api.QueueSubscription(subscription) })
+	// Log the message
+	if errUpdateSubscription != nil {
+		c.reportError(errUpdateSubscription)
+		return errUpdateSubscription
+	}
+	c.logger.Debug("Update Subscription successfully added to the queue")
+	return nil
+}
+
+// Update Subscriptions Batch
+func (c *Client) UpdateSubscriptionsBatch(subscriptions []*models.SubscriptionModel) error {
+	// Add event to the queue
+	errUpdateSubscriptionsBatch := c.queue(len(subscriptions), func() error { return c.api.QueueSubscriptions(subscriptions) })
+	// Log the message
+	if errUpdateSubscriptionsBatch != nil {
+		c.reportError(errUpdateSubscriptionsBatch)
+		return errUpdateSubscriptionsBatch
+	}
+	c.logger.Debug("Updated subscriptions successfully added to the queue")
+	return nil
+}
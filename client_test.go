@@ -0,0 +1,399 @@
+package moesifmiddleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	moesifapi "github.com/moesif/moesifapi-go"
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// fakeAPI records queued events instead of sending them to Moesif
+type fakeAPI struct {
+	moesifapi.API
+	mu      sync.Mutex
+	events  []*models.EventModel
+	users   []*models.UserModel
+	flushes int
+	block   chan struct{} // if set, Flush waits for it to be closed
+	full    bool          // if set, the queue rejects everything
+}
+
+var errQueueFull = errors.New("queue is full")
+
+func (f *fakeAPI) QueueUser(u *models.UserModel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.full {
+		return errQueueFull
+	}
+	f.users = append(f.users, u)
+	return nil
+}
+
+func (f *fakeAPI) Flush() {
+	if f.block != nil {
+		<-f.block
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushes++
+}
+
+func (f *fakeAPI) Close() {
+	f.Flush()
+}
+
+func (f *fakeAPI) QueueEvent(e *models.EventModel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.full {
+		return errQueueFull
+	}
+	f.events = append(f.events, e)
+	return nil
+}
+
+func (f *fakeAPI) Events() []*models.EventModel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.events
+}
+
+// newTestClient returns a Client for config that queues events to a fakeAPI
+// and does not fetch config or rules from Moesif
+func newTestClient(config *Config) (*Client, *fakeAPI) {
+	api := &fakeAPI{}
+	return newClient(config, api, false), api
+}
+
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, target, r)
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+var echo = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+})
+
+func TestClientsHaveIndependentOptions(t *testing.T) {
+	withBody := NewConfig("app")
+	withoutBody := NewConfig("app")
+	withoutBody.LogBody = false
+	withoutBody.ApiVersion = "2"
+	c1, api1 := newTestClient(withBody)
+	c2, api2 := newTestClient(withoutBody)
+
+	for _, c := range []*Client{c1, c2} {
+		response := serve(c.Middleware(echo), "POST", "/items", `{"name":"a"}`)
+		if response.Body.String() != `{"name":"a"}` {
+			t.Errorf("handler did not see the request body, got %q", response.Body.String())
+		}
+	}
+
+	e1, e2 := api1.Events(), api2.Events()
+	if len(e1) != 1 || len(e2) != 1 {
+		t.Fatalf("expected one event per client, got %d and %d", len(e1), len(e2))
+	}
+	if e1[0].Response.Body == nil || e1[0].Request.ApiVersion != nil {
+		t.Errorf("client 1 did not use its own options: %#v", e1[0])
+	}
+	if e2[0].Response.Body != nil || *e2[0].Request.ApiVersion != "2" {
+		t.Errorf("client 2 did not use its own options: %#v", e2[0])
+	}
+}
+
+// newMoesifServer returns a stand-in for the Moesif API that serves config
+// tagged with the value of eTag, and tags event batches with it
+func newMoesifServer(eTag *atomic.Value) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tag, _ := eTag.Load().(string)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/config"):
+			rw.Header().Set("X-Moesif-Config-ETag", tag)
+			rw.Write([]byte(`{"sample_rate":100}`))
+		case strings.HasSuffix(r.URL.Path, "/rules"):
+			rw.Write([]byte(`[]`))
+		default:
+			ioutil.ReadAll(r.Body)
+			rw.Header().Set("X-Moesif-Config-ETag", tag)
+			rw.WriteHeader(http.StatusCreated)
+		}
+	}))
+}
+
+func newServerConfig(applicationId string, server *httptest.Server) *Config {
+	config := NewConfig(applicationId)
+	config.ApiEndpoint = server.URL
+	return config
+}
+
+func closeClient(t *testing.T, c *Client) {
+	if _, err := c.Close(context.Background()); err != nil {
+		t.Errorf("unexpected error closing client: %v", err)
+	}
+}
+
+func TestNewClientRejectsSecondApplicationId(t *testing.T) {
+	server := newMoesifServer(&atomic.Value{})
+	defer server.Close()
+	config := newServerConfig("app-a", server)
+	c1, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeClient(t, c1)
+	c2, err := NewClient(newServerConfig("app-a", server))
+	if err != nil {
+		t.Fatalf("same Application_Id should be accepted, got %v", err)
+	}
+	defer closeClient(t, c2)
+	if c1.api != c2.api {
+		t.Errorf("clients with the same Application_Id should share the Moesif API client")
+	}
+	if _, err := NewClient(newServerConfig("app-b", server)); err != errApiIdentityConflict {
+		t.Errorf("expected errApiIdentityConflict, got %v", err)
+	}
+	batched := newServerConfig("app-a", server)
+	batched.BatchSize = config.BatchSize + 1
+	if _, err := NewClient(batched); err != errApiIdentityConflict {
+		t.Errorf("expected errApiIdentityConflict for another Batch_Size, got %v", err)
+	}
+}
+
+func TestDefaultClientRejectsSecondApplicationId(t *testing.T) {
+	server := newMoesifServer(&atomic.Value{})
+	defer server.Close()
+	c, err := NewClient(newServerConfig("app-a", server))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeClient(t, c)
+	if _, err := MoesifMiddlewareWithConfig(echo, newServerConfig("app-b", server)); err != errApiIdentityConflict {
+		t.Errorf("expected errApiIdentityConflict, got %v", err)
+	}
+	options := map[string]interface{}{"Application_Id": "app-b", "Api_Endpoint": server.URL}
+	if response := serve(MoesifMiddleware(echo, options), "GET", "/items", ""); response.Code != http.StatusOK {
+		t.Errorf("expected the request to be served, got %d", response.Code)
+	}
+	if err := UpdateUser(&models.UserModel{UserId: "1"}, options); err != errApiIdentityConflict {
+		t.Errorf("expected errApiIdentityConflict, got %v", err)
+	}
+	if currentDefaultClient() != nil {
+		t.Errorf("the conflicting default client should not start")
+	}
+}
+
+func TestNewClientWhileAnotherServes(t *testing.T) {
+	server := newMoesifServer(&atomic.Value{})
+	defer server.Close()
+	c1, err := NewClient(newServerConfig("app", server))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := c1.Middleware(echo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			serve(handler, "POST", "/items", `{"name":"a"}`)
+		}
+		c1.Flush(context.Background())
+	}()
+	for i := 0; i < 5; i++ {
+		c2, err := NewClient(newServerConfig("app", server))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		serve(c2.Middleware(echo), "GET", "/items", "")
+		closeClient(t, c2)
+	}
+	<-done
+	closeClient(t, c1)
+}
+
+func TestSharedApiNotifiesEveryClient(t *testing.T) {
+	eTag := &atomic.Value{}
+	eTag.Store("v1")
+	server := newMoesifServer(eTag)
+	defer server.Close()
+	c1, err := NewClient(newServerConfig("app", server))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeClient(t, c1)
+	c2, err := NewClient(newServerConfig("app", server))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeClient(t, c2)
+	waitForETag(t, c1, "v1")
+	waitForETag(t, c2, "v1")
+
+	// only c1 sends an event, but the new tag reaches both clients
+	eTag.Store("v2")
+	serve(c1.Middleware(echo), "GET", "/items", "")
+	if err := c1.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitForETag(t, c1, "v2")
+	waitForETag(t, c2, "v2")
+}
+
+func waitForETag(t *testing.T, c *Client, eTag string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if c.appConfig.Read().eTag == eTag {
+			return
+		}
+	}
+	t.Fatalf("client did not fetch config %q, has %q", eTag, c.appConfig.Read().eTag)
+}
+
+func TestCloseFlushesAndDropsLaterEvents(t *testing.T) {
+	c, api := newTestClient(NewConfig("app"))
+	handler := c.Middleware(echo)
+	serve(handler, "GET", "/items", "")
+
+	dropped, err := c.Close(context.Background())
+	if err != nil || dropped != 0 {
+		t.Fatalf("expected a clean close, got dropped=%d err=%v", dropped, err)
+	}
+	if api.flushes != 1 {
+		t.Errorf("expected Close to flush once, got %d", api.flushes)
+	}
+
+	serve(handler, "GET", "/items", "")
+	if err := c.UpdateUser(&models.UserModel{UserId: "1"}); err != errClientClosed {
+		t.Errorf("expected errClientClosed, got %v", err)
+	}
+	if len(api.Events()) != 1 || len(api.users) != 0 {
+		t.Errorf("nothing should be queued after Close")
+	}
+	if dropped, err = c.Close(context.Background()); err != errClientClosed || dropped != 2 {
+		t.Errorf("expected 2 dropped and errClientClosed, got dropped=%d err=%v", dropped, err)
+	}
+}
+
+func TestCloseDeadline(t *testing.T) {
+	c, api := newTestClient(NewConfig("app"))
+	api.block = make(chan struct{})
+	defer close(api.block)
+	serve(c.Middleware(echo), "GET", "/items", "")
+	c.UpdateUser(&models.UserModel{UserId: "1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dropped, err := c.Close(ctx)
+	if err != context.DeadlineExceeded || dropped != 2 {
+		t.Errorf("expected 2 dropped at the deadline, got dropped=%d err=%v", dropped, err)
+	}
+}
+
+func TestCloseDeadlineKeepsApiIdentity(t *testing.T) {
+	config := NewConfig("app-a")
+	c, api := newTestClient(config)
+	api.block = make(chan struct{})
+	c.sharedApi = true
+	apiIdentity.Lock()
+	apiIdentity.settings, apiIdentity.api, apiIdentity.refs = newApiSettings(config), api, 1
+	apiIdentity.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the flush to outlast the deadline, got %v", err)
+	}
+	// the shared API client is still flushing, so no other can start
+	if _, err := NewClient(NewConfig("app-b")); err != errApiIdentityConflict {
+		t.Errorf("expected errApiIdentityConflict during the final flush, got %v", err)
+	}
+
+	close(api.block)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		apiIdentity.Lock()
+		refs := apiIdentity.refs
+		apiIdentity.Unlock()
+		if refs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the identity was not released after the final flush")
+		}
+	}
+	if api.flushes != 2 {
+		t.Errorf("expected the final flush and Close, got %d flushes", api.flushes)
+	}
+}
+
+func TestCloseDuringFlush(t *testing.T) {
+	c, api := newTestClient(NewConfig("app"))
+	api.block = make(chan struct{})
+	defer close(api.block)
+	serve(c.Middleware(echo), "GET", "/items", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the flush to outlast the deadline, got %v", err)
+	}
+
+	// neither requests nor Close wait for the flush still in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(c.Middleware(echo), "GET", "/items", "")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if dropped, err := c.Close(ctx); err != context.DeadlineExceeded || dropped != 2 {
+			t.Errorf("expected 2 dropped at the deadline, got dropped=%d err=%v", dropped, err)
+		}
+		if err := c.UpdateUser(&models.UserModel{UserId: "1"}); err != errClientClosed {
+			t.Errorf("expected errClientClosed, got %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("requests or Close blocked on the in-flight flush")
+	}
+}
+
+func TestQueueErrorsAreReported(t *testing.T) {
+	config := NewConfig("app")
+	var reported []error
+	config.OnError = func(err error) {
+		reported = append(reported, err)
+	}
+	c, api := newTestClient(config)
+	api.full = true
+
+	response := serve(c.Middleware(echo), "POST", "/items", `{"a":1}`)
+	if response.Code != http.StatusOK {
+		t.Errorf("expected the request to be served, got %d", response.Code)
+	}
+	if err := c.UpdateUser(&models.UserModel{UserId: "1"}); err != errQueueFull {
+		t.Errorf("expected errQueueFull, got %v", err)
+	}
+	if len(reported) != 2 || c.Dropped() != 2 {
+		t.Errorf("expected 2 reported and dropped, got %v and %d", reported, c.Dropped())
+	}
+}
@@ -21,9 +21,12 @@ func getClientIpFromXForwardedFor(ipAddress string) string {
 	// A Squid configuration directive can also set the value to "unknown" (http://www.squid-cache.org/Doc/config/forwarded_for/)
 	for _, ip := range ips {
 
-		// Azure Web App's also adds a port for some reason, so we'll only use the first part (the IP)
-		if strings.Contains(ip, ":") {
-			ip = strings.Split(ip, ":")[0]
+		// Azure Web App's also adds a port for some reason, so we'll only use the host part.
+		// IPv6 addresses contain colons too, and have their port in the [host]:port form
+		if !validIp(ip) {
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
 		}
 
 		// x-forwarded-for may return multiple IP addresses in the format:
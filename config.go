@@ -0,0 +1,289 @@
+package moesifmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Config is the typed form of the moesifOption map documented in the README.
+// Use NewConfig to get a Config with the documented defaults applied, or
+// ConfigFromMap to convert an existing options map.
+type Config struct {
+	ApplicationId           string
+	ApiEndpoint             string
+	ApiVersion              string
+	EventQueueSize          int
+	BatchSize               int
+	TimerWakeUpSeconds      int
+	Debug                   bool
+	DisableTransactionId    bool
+	LogBody                 bool
+	LogBodyOutgoing         bool
+	CaptureOutgoingRequests bool
+
+	// Maximum number of request and response body bytes captured for logging,
+	// 0 for no limit. Larger bodies are logged truncated.
+	MaxRequestBodySize  int
+	MaxResponseBodySize int
+
+	// StreamRequestBody captures the request body as the handler reads it,
+	// instead of reading it before the handler runs
+	StreamRequestBody bool
+
+	// BodyParsers parse bodies by Content-Type, keyed by media type, by type
+	// with a wildcard subtype like "text/*", or by suffix like "+xml". They take
+	// precedence over JSON and the default parsers.
+	BodyParsers map[string]BodyParser
+
+	// PIIDetectors names the built-in detectors, from PIIDetectorNames, whose
+	// matches are redacted from bodies, headers and the URI. PIIPatterns are
+	// redacted the same way.
+	PIIDetectors []string
+	PIIPatterns  []*regexp.Regexp
+
+	// Logger receives log output, which goes to the standard log package if it is not set
+	Logger Logger
+
+	// OnError is called when an event, user, company or subscription cannot
+	// be queued. Errors are logged if it is not set.
+	OnError func(error)
+
+	// Incoming event callbacks
+	ShouldSkip      func(*http.Request, MoesifResponseRecorder) bool
+	IdentifyUser    func(*http.Request, MoesifResponseRecorder) string
+	IdentifyCompany func(*http.Request, MoesifResponseRecorder) string
+	GetSessionToken func(*http.Request, MoesifResponseRecorder) string
+	GetMetadata     func(*http.Request, MoesifResponseRecorder) map[string]interface{}
+
+	// IsBot classifies incoming requests as bot traffic instead of the
+	// User-Agent. Bot traffic is not captured if the app config sets
+	// block_bot_traffic, and is blocked with a 403 if BlockBotRequests is set.
+	IsBot            func(*http.Request) bool
+	BlockBotRequests bool
+
+	// BlockedIPResponse is the response to requests from addresses blocked by
+	// the ip_addresses_blocked_by_name app config, with a 403 status if it
+	// sets none
+	BlockedIPResponse TemplatedOverrideValues
+
+	// TrustedProxies lists the addresses and CIDR ranges of the proxies in front
+	// of the server. IP blocks apply to the connecting address or, if it is a
+	// trusted proxy, to the last X-Forwarded-For address that is not.
+	TrustedProxies []string
+
+	// GovernanceShadowMode, or ShadowRuleIds for individual rules, records
+	// matching governance rules in the event metadata and passes them to
+	// OnShadowRuleMatch without applying their overrides to the response
+	GovernanceShadowMode bool
+	ShadowRuleIds        []string
+	OnShadowRuleMatch    func(*http.Request, []RuleTemplate)
+
+	// AppConfigFile and GovernanceRulesFile are JSON or YAML files of app config
+	// and governance rules, merged with those from Moesif or, if
+	// ReplaceRemoteConfig is set, used instead of them. The files are checked
+	// for changes every ConfigFileReloadSeconds, 5 if it is 0. Reloading is
+	// turned off if it is negative.
+	AppConfigFile           string
+	GovernanceRulesFile     string
+	ReplaceRemoteConfig     bool
+	ConfigFileReloadSeconds int
+
+	// ConfigCacheDir is a directory where the last app config and governance
+	// rules fetched from Moesif are saved, and loaded from at startup if they
+	// are at most ConfigCacheMaxAge seconds old, 24 hours if it is 0. There is
+	// no age limit if it is negative.
+	ConfigCacheDir    string
+	ConfigCacheMaxAge int
+
+	// Masks shared by incoming and outgoing events
+	RequestHeaderMasks  func() []string
+	RequestBodyMasks    func() []string
+	ResponseHeaderMasks func() []string
+	ResponseBodyMasks   func() []string
+
+	// MaskStrategies replace the values of the header and body masks they are
+	// keyed by, which are replaced with "*****" if they have no strategy
+	MaskStrategies map[string]MaskStrategy
+
+	// UnmaskedHeaders lists DefaultHeaderMasks headers that are logged unmasked
+	UnmaskedHeaders []string
+
+	// QueryParamMasks names the query parameters to mask in the URI, and
+	// MaskPathSegments returns the URI path segments with any masked
+	QueryParamMasks  func() []string
+	MaskPathSegments func(segments []string) []string
+
+	// CookieMasks names the cookies to mask in Cookie and Set-Cookie headers
+	CookieMasks func() []string
+
+	// Outgoing event callbacks
+	ShouldSkipOutgoing      func(*http.Request, *http.Response) bool
+	IdentifyUserOutgoing    func(*http.Request, *http.Response) string
+	IdentifyCompanyOutgoing func(*http.Request, *http.Response) string
+	GetSessionTokenOutgoing func(*http.Request, *http.Response) string
+	GetMetadataOutgoing     func(*http.Request, *http.Response) map[string]interface{}
+}
+
+// NewConfig returns a Config for applicationId with the defaults used when an
+// option is missing from the options map.
+func NewConfig(applicationId string) *Config {
+	return &Config{
+		ApplicationId:   applicationId,
+		LogBody:         true,
+		LogBodyOutgoing: true,
+	}
+}
+
+// options maps each moesifOption key to the Config field it sets
+func (c *Config) options() map[string]interface{} {
+	return map[string]interface{}{
+		"Application_Id":             &c.ApplicationId,
+		"Api_Endpoint":               &c.ApiEndpoint,
+		"Api_Version":                &c.ApiVersion,
+		"Event_Queue_Size":           &c.EventQueueSize,
+		"Batch_Size":                 &c.BatchSize,
+		"Timer_Wake_Up_Seconds":      &c.TimerWakeUpSeconds,
+		"Debug":                      &c.Debug,
+		"disableTransactionId":       &c.DisableTransactionId,
+		"Log_Body":                   &c.LogBody,
+		"Log_Body_Outgoing":          &c.LogBodyOutgoing,
+		"Capture_Outoing_Requests":   &c.CaptureOutgoingRequests,
+		"Max_Request_Body_Size":      &c.MaxRequestBodySize,
+		"Max_Response_Body_Size":     &c.MaxResponseBodySize,
+		"Stream_Request_Body":        &c.StreamRequestBody,
+		"Body_Parsers":               &c.BodyParsers,
+		"PII_Detectors":              &c.PIIDetectors,
+		"PII_Patterns":               &c.PIIPatterns,
+		"On_Error":                   &c.OnError,
+		"Logger":                     &c.Logger,
+		"Should_Skip":                &c.ShouldSkip,
+		"Is_Bot":                     &c.IsBot,
+		"Block_Bot_Requests":         &c.BlockBotRequests,
+		"Blocked_IP_Response":        &c.BlockedIPResponse,
+		"Trusted_Proxies":            &c.TrustedProxies,
+		"Governance_Shadow_Mode":     &c.GovernanceShadowMode,
+		"Shadow_Rule_Ids":            &c.ShadowRuleIds,
+		"On_Shadow_Rule_Match":       &c.OnShadowRuleMatch,
+		"App_Config_File":            &c.AppConfigFile,
+		"Governance_Rules_File":      &c.GovernanceRulesFile,
+		"Replace_Remote_Config":      &c.ReplaceRemoteConfig,
+		"Config_File_Reload_Seconds": &c.ConfigFileReloadSeconds,
+		"Config_Cache_Dir":           &c.ConfigCacheDir,
+		"Config_Cache_Max_Age":       &c.ConfigCacheMaxAge,
+		"Identify_User":              &c.IdentifyUser,
+		"Identify_Company":           &c.IdentifyCompany,
+		"Get_Session_Token":          &c.GetSessionToken,
+		"Get_Metadata":               &c.GetMetadata,
+		"Request_Header_Masks":       &c.RequestHeaderMasks,
+		"Request_Body_Masks":         &c.RequestBodyMasks,
+		"Response_Header_Masks":      &c.ResponseHeaderMasks,
+		"Response_Body_Masks":        &c.ResponseBodyMasks,
+		"Mask_Strategies":            &c.MaskStrategies,
+		"Unmasked_Headers":           &c.UnmaskedHeaders,
+		"Query_Param_Masks":          &c.QueryParamMasks,
+		"Mask_Path_Segments":         &c.MaskPathSegments,
+		"Cookie_Masks":               &c.CookieMasks,
+		"Should_Skip_Outgoing":       &c.ShouldSkipOutgoing,
+		"Identify_User_Outgoing":     &c.IdentifyUserOutgoing,
+		"Identify_Company_Outgoing":  &c.IdentifyCompanyOutgoing,
+		"Get_Session_Token_Outgoing": &c.GetSessionTokenOutgoing,
+		"Get_Metadata_Outgoing":      &c.GetMetadataOutgoing,
+	}
+}
+
+// ConfigError lists every problem found in a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "moesif: invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// ConfigFromMap converts a moesifOption map to a Config. Options that are
+// unknown or hold a value of the wrong type are left at their defaults and
+// reported, together with any Validate problems, in the returned *ConfigError.
+// The returned Config is never nil.
+func ConfigFromMap(options map[string]interface{}) (*Config, error) {
+	config := NewConfig("")
+	fields := config.options()
+	var problems []string
+	for name, value := range options {
+		field, found := fields[name]
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: unknown option", name))
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		target := reflect.ValueOf(field).Elem()
+		v := reflect.ValueOf(value)
+		if !v.Type().AssignableTo(target.Type()) {
+			problems = append(problems, fmt.Sprintf("%s: expected %s, got %T", name, target.Type(), value))
+			continue
+		}
+		target.Set(v)
+	}
+	sort.Strings(problems)
+	if err, ok := config.Validate().(*ConfigError); ok {
+		problems = append(problems, err.Problems...)
+	}
+	if len(problems) > 0 {
+		return config, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// Validate reports every problem with c as a *ConfigError, or nil if c is usable
+func (c *Config) Validate() error {
+	var problems []string
+	if c.ApplicationId == "" {
+		problems = append(problems, "Application_Id: required")
+	}
+	if c.ApiEndpoint != "" {
+		if u, err := url.Parse(c.ApiEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("Api_Endpoint: %q is not an http(s) URL", c.ApiEndpoint))
+		}
+	}
+	if c.EventQueueSize < 0 {
+		problems = append(problems, "Event_Queue_Size: must not be negative")
+	}
+	if c.BatchSize < 0 {
+		problems = append(problems, "Batch_Size: must not be negative")
+	}
+	if c.EventQueueSize > 0 && c.BatchSize > c.EventQueueSize {
+		problems = append(problems, "Batch_Size: must not exceed Event_Queue_Size")
+	}
+	if c.TimerWakeUpSeconds < 0 {
+		problems = append(problems, "Timer_Wake_Up_Seconds: must not be negative")
+	}
+	if c.MaxRequestBodySize < 0 {
+		problems = append(problems, "Max_Request_Body_Size: must not be negative")
+	}
+	if c.MaxResponseBodySize < 0 {
+		problems = append(problems, "Max_Response_Body_Size: must not be negative")
+	}
+	if c.ReplaceRemoteConfig && c.AppConfigFile == "" && c.GovernanceRulesFile == "" {
+		problems = append(problems, "Replace_Remote_Config: requires App_Config_File or Governance_Rules_File")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if l := newIPBlockList(nil); !l.add(proxy, "") {
+			problems = append(problems, fmt.Sprintf("Trusted_Proxies: %q is not an IP address or CIDR range", proxy))
+		}
+	}
+	for _, name := range c.PIIDetectors {
+		if !contains(PIIDetectorNames, name) {
+			problems = append(problems, fmt.Sprintf("PII_Detectors: unknown detector %q", name))
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
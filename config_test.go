@@ -0,0 +1,71 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFromMap(t *testing.T) {
+	config, err := ConfigFromMap(map[string]interface{}{
+		"Application_Id": "app",
+		"Batch_Size":     50,
+		"Log_Body":       false,
+		"Should_Skip": func(*http.Request, MoesifResponseRecorder) bool {
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.ApplicationId != "app" || config.BatchSize != 50 || config.LogBody || !config.LogBodyOutgoing {
+		t.Errorf("options not applied: %#v", config)
+	}
+	if config.ShouldSkip == nil || !config.ShouldSkip(nil, MoesifResponseRecorder{}) {
+		t.Error("Should_Skip not applied")
+	}
+}
+
+func TestConfigFromMapReportsAllProblems(t *testing.T) {
+	config, err := ConfigFromMap(map[string]interface{}{
+		"Batch_Size":   "50",
+		"Identify_Usr": func(*http.Request, MoesifResponseRecorder) string { return "" },
+		"Should_Skip":  func(*http.Request) bool { return true },
+	})
+	if config == nil {
+		t.Fatal("expected a config with defaults")
+	}
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected *ConfigError, got %v", err)
+	}
+	expected := []string{
+		"Batch_Size: expected int, got string",
+		"Identify_Usr: unknown option",
+		"Should_Skip: expected func(*http.Request, moesifmiddleware.MoesifResponseRecorder) bool, got func(*http.Request) bool",
+		"Application_Id: required",
+	}
+	if !reflect.DeepEqual(configErr.Problems, expected) {
+		t.Errorf("got problems %q, expected %q", configErr.Problems, expected)
+	}
+	if config.ShouldSkip != nil {
+		t.Error("mistyped Should_Skip should be left unset")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := NewConfig("app")
+	if err := config.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	config.ApiEndpoint = "api.moesif.net"
+	config.EventQueueSize = 10
+	config.BatchSize = 20
+	config.TimerWakeUpSeconds = -1
+	config.MaxRequestBodySize = -1
+	config.TrustedProxies = []string{"10.0.0.0/8", "::1", "proxy.internal"}
+	err, ok := config.Validate().(*ConfigError)
+	if !ok || len(err.Problems) != 5 {
+		t.Errorf("expected 5 problems, got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package moesifmiddleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+// defaultConfigCacheMaxAge is how old a cached app config or rules can be to be
+// used at startup if Config_Cache_Max_Age is not set
+const defaultConfigCacheMaxAge = 24 * time.Hour
+
+// configCache persists the last app config and governance rules fetched from
+// Moesif in the Config_Cache_Dir directory, so that they apply from the first
+// request after a restart. A nil configCache caches nothing.
+type configCache struct {
+	dir    string
+	prefix string // identifies the application without writing its Application Id
+	maxAge time.Duration
+	log    Logger
+}
+
+// cacheEntry is a cached app config or list of rules
+type cacheEntry struct {
+	SavedAt time.Time       `json:"saved_at"`
+	ETag    string          `json:"etag"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// newConfigCache returns the cache for the Config_Cache_Dir and
+// Config_Cache_Max_Age options, or nil if Config_Cache_Dir is not set
+func newConfigCache(config *Config, logger Logger) *configCache {
+	if config.ConfigCacheDir == "" {
+		return nil
+	}
+	maxAge := defaultConfigCacheMaxAge
+	if config.ConfigCacheMaxAge > 0 {
+		maxAge = time.Duration(config.ConfigCacheMaxAge) * time.Second
+	} else if config.ConfigCacheMaxAge < 0 {
+		maxAge = 0
+	}
+	sum := sha256.Sum256([]byte(config.ApplicationId))
+	return &configCache{
+		dir:    config.ConfigCacheDir,
+		prefix: "moesif-" + hex.EncodeToString(sum[:8]),
+		maxAge: maxAge,
+		log:    logger,
+	}
+}
+
+func (c *configCache) path(name string) string {
+	return filepath.Join(c.dir, c.prefix+"-"+name+".json")
+}
+
+// save writes data with its eTag to the cache file for name, replacing the
+// file atomically so that a crash cannot leave it half written
+func (c *configCache) save(name, eTag string, data interface{}) {
+	if c == nil {
+		return
+	}
+	err := func() error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		entry, err := json.Marshal(cacheEntry{SavedAt: time.Now().UTC(), ETag: eTag, Data: raw})
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(c.dir, 0o700); err != nil {
+			return err
+		}
+		f, err := ioutil.TempFile(c.dir, c.prefix+"-*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(entry); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), c.path(name))
+	}()
+	if err != nil {
+		c.log.Warn("Unable to save config cache", "path", c.path(name), "error", err)
+	}
+}
+
+// load returns the cached data and eTag for name, and false if there is none
+// or it is older than the maximum age
+func (c *configCache) load(name string) (data json.RawMessage, eTag string, ok bool) {
+	if c == nil {
+		return nil, "", false
+	}
+	b, err := ioutil.ReadFile(c.path(name))
+	if os.IsNotExist(err) {
+		return nil, "", false
+	}
+	var entry cacheEntry
+	if err == nil {
+		err = json.Unmarshal(b, &entry)
+	}
+	if err != nil {
+		c.log.Warn("Unable to read config cache", "path", c.path(name), "error", err)
+		return nil, "", false
+	}
+	if age := time.Since(entry.SavedAt); c.maxAge > 0 && age > c.maxAge {
+		c.log.Info("Ignoring stale config cache", "path", c.path(name), "saved_at", entry.SavedAt, "max_age", c.maxAge)
+		return nil, "", false
+	}
+	return entry.Data, entry.ETag, true
+}
+
+// saveAppConfig caches an app config fetched from Moesif
+func (c *configCache) saveAppConfig(config AppConfigResponse) {
+	c.save("config", config.eTag, config)
+}
+
+// loadAppConfig returns the cached app config, and false if there is none
+func (c *configCache) loadAppConfig() (config AppConfigResponse, ok bool) {
+	data, eTag, ok := c.load("config")
+	if !ok {
+		return config, false
+	}
+	config = NewAppConfigResponse()
+	if err := json.Unmarshal(data, &config); err != nil {
+		c.log.Warn("Unable to read cached app config", "error", err)
+		return config, false
+	}
+	config.eTag = eTag
+	return config, true
+}
+
+// cachedRule is a governance rule with its response body as raw JSON, the form
+// the /rules endpoint sends. moesifapi.BodyTemplate keeps the raw JSON of a
+// body but marshals it as a string, which would not load back the same.
+type cachedRule struct {
+	moesifapi.GovernanceRule
+	Response cachedResponse `json:"response"`
+}
+
+type cachedResponse struct {
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Status  int               `json:"status"`
+}
+
+// saveRules caches governance rules fetched from Moesif
+func (c *configCache) saveRules(rules []moesifapi.GovernanceRule, eTag string) {
+	if c == nil {
+		return
+	}
+	cached := make([]cachedRule, len(rules))
+	for i, r := range rules {
+		body := json.RawMessage(r.ResponseOverrides.Body)
+		if len(body) > 0 && !json.Valid(body) {
+			body, _ = json.Marshal(string(r.ResponseOverrides.Body))
+		}
+		cached[i] = cachedRule{r, cachedResponse{body, r.ResponseOverrides.Headers, r.ResponseOverrides.Status}}
+	}
+	c.save("rules", eTag, cached)
+}
+
+// loadRules returns the cached governance rules, and false if there are none
+func (c *configCache) loadRules() (rules []moesifapi.GovernanceRule, eTag string, ok bool) {
+	data, eTag, ok := c.load("rules")
+	if !ok {
+		return nil, "", false
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		c.log.Warn("Unable to read cached governance rules", "error", err)
+		return nil, "", false
+	}
+	return rules, eTag, true
+}
@@ -0,0 +1,122 @@
+package moesifmiddleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+// tempDir creates a directory for a test, removed by calling cleanup
+func tempDir(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "moesif-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newCacheTestClient(dir string, maxAge int) *Client {
+	config := NewConfig("app")
+	config.ConfigCacheDir = dir
+	config.ConfigCacheMaxAge = maxAge
+	c, _ := newTestClient(config)
+	return c
+}
+
+func TestConfigCacheColdStart(t *testing.T) {
+	tmp, cleanup := tempDir(t)
+	defer cleanup()
+	dir := filepath.Join(tmp, "cache")
+	var rules []moesifapi.GovernanceRule
+	json.Unmarshal([]byte(`[{"_id":"block","type":"regex","block":true,
+		"regex_config":[{"conditions":[{"path":"request.route","value":"^/items"}]}],
+		"response":{"status":429,"headers":{"Content-Type":"application/json"},"body":{"error":"slow down"}}}]`), &rules)
+	remote := NewAppConfigResponse()
+	remote.SampleRate = 25
+	remote.UserSampleRate = map[string]int{"u1": 5}
+	remote.eTag = "config-etag"
+
+	// a running client saves what it fetches
+	running := newCacheTestClient(dir, 0)
+	running.appConfig.writeRemote(remote)
+	running.governanceRules.writeRemote(rules, "rules-etag")
+
+	// a new client applies it from the first request
+	c := newCacheTestClient(dir, 0)
+	config := c.appConfig.Read()
+	if config.SampleRate != 25 || !reflect.DeepEqual(config.UserSampleRate, remote.UserSampleRate) || config.eTag != "config-etag" {
+		t.Errorf("got cached app config %+v", config)
+	}
+	if c.governanceRules.Read().eTag != "rules-etag" {
+		t.Errorf("got cached rules eTag %q", c.governanceRules.Read().eTag)
+	}
+	response := serve(c.Middleware(echo), "GET", "/items", "")
+	if response.Code != http.StatusTooManyRequests || response.Body.String() != `{"error":"slow down"}` || response.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got %d %q from a cached rule", response.Code, response.Body)
+	}
+
+	// a refresh with a known eTag is not fetched again
+	c.appConfig.Notify("config-etag")
+	if len(c.appConfig.Updates) != 0 {
+		t.Error("expected the cached eTag to suppress a refresh")
+	}
+}
+
+func TestConfigCacheMaxAge(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	newCacheTestClient(dir, 0).appConfig.writeRemote(AppConfigResponse{SampleRate: 25})
+
+	// age the cache by an hour
+	path := newConfigCache(&Config{ApplicationId: "app", ConfigCacheDir: dir}, defaultLogger).path("config")
+	var entry cacheEntry
+	b, _ := ioutil.ReadFile(path)
+	json.Unmarshal(b, &entry)
+	entry.SavedAt = entry.SavedAt.Add(-time.Hour)
+	b, _ = json.Marshal(entry)
+	ioutil.WriteFile(path, b, 0o600)
+
+	for _, test := range []struct {
+		maxAge   int
+		expected int
+	}{
+		{60, 100},  // stale
+		{7200, 25}, // fresh
+		{0, 25},    // within the default
+		{-1, 25},   // no limit
+	} {
+		c := newCacheTestClient(dir, test.maxAge)
+		if rate := c.appConfig.Read().SampleRate; rate != test.expected {
+			t.Errorf("max age %d: got sample rate %d, expected %d", test.maxAge, rate, test.expected)
+		}
+	}
+}
+
+func TestConfigCacheIsPerApplication(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	newCacheTestClient(dir, 0).appConfig.writeRemote(AppConfigResponse{SampleRate: 25})
+	other := NewConfig("other app")
+	other.ConfigCacheDir = dir
+	if _, ok := newConfigCache(other, defaultLogger).loadAppConfig(); ok {
+		t.Error("loaded another application's cached config")
+	}
+}
+
+func TestConfigCacheInvalidFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	c := newCacheTestClient(dir, 0)
+	ioutil.WriteFile(c.appConfig.cache.path("config"), []byte("{"), 0o600)
+	c.loadConfigCache()
+	if rate := c.appConfig.Read().SampleRate; rate != 100 {
+		t.Errorf("got sample rate %d from an invalid cache file", rate)
+	}
+}
@@ -0,0 +1,120 @@
+package moesifmiddleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// bodyDecoders maps each supported Content-Encoding to a function returning a
+// reader of the decoded body
+var bodyDecoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		// deflate is zlib wrapped, but some servers send raw deflate
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	},
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// maxDecodedBodySize limits the decoded size of encoded bodies when no maximum
+// body size is set, so a small compressed body cannot inflate without bound
+const maxDecodedBodySize = 1 << 20
+
+// decodeBody decodes body by contentEncoding, which lists the encodings in the
+// order they were applied, keeping at most max decoded bytes, or
+// maxDecodedBodySize bytes if max is 0.
+// A body that is only partly decoded, because it was truncated for logging, is
+// returned with the error. decoded is nil if nothing was decoded.
+func decodeBody(body []byte, contentEncoding string, max int) (decoded []byte, truncated bool, err error) {
+	var r io.Reader = bytes.NewReader(body)
+	decoders := 0
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+		newDecoder, ok := bodyDecoders[encoding]
+		if !ok {
+			return nil, false, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+		}
+		d, err := newDecoder(r)
+		if err != nil {
+			return nil, false, err
+		}
+		defer d.Close()
+		r = d
+		decoders++
+	}
+	if decoders == 0 {
+		return nil, false, nil
+	}
+	if max <= 0 {
+		max = maxDecodedBodySize
+	}
+	decoded, err = ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if len(decoded) == 0 && err != nil {
+		return nil, false, err
+	}
+	if len(decoded) > max {
+		decoded, truncated = decoded[:max], true
+	}
+	return decoded, truncated, err
+}
+
+// parseEncodedBody decodes body by its Content-Encoding header before parsing
+// and masking it. The Content-Encoding is recorded under info as
+// name_content_encoding if the body was decoded. truncated reports whether body
+// is only the start of the captured body. A truncated body that cannot be
+// parsed is not logged, since its masked fields cannot be found.
+func (c *Client) parseEncodedBody(body []byte, truncated bool, header http.Header, max int, masks func() []string, info map[string]interface{}, name string) (interface{}, string) {
+	if contentEncoding := header.Get("Content-Encoding"); contentEncoding != "" && len(body) > 0 {
+		decoded, decodedTruncated, err := decodeBody(body, contentEncoding, max)
+		if err != nil {
+			c.logger.Debug("Error while decoding body", "content_encoding", contentEncoding, "error", err)
+		}
+		if decoded != nil {
+			info[name+"_content_encoding"] = contentEncoding
+			if decodedTruncated {
+				info[name+"_body_truncated"] = true
+				truncated = true
+			}
+			body = decoded
+		}
+	}
+	parsed, encoding := c.parseBody(body, header.Get("Content-Type"), masks)
+	if truncated && encoding == "base64" {
+		c.logger.Debug("Skipping truncated body that cannot be parsed", "body", name, "length", len(body))
+		return nil, ""
+	}
+	return parsed, encoding
+}
@@ -0,0 +1,130 @@
+package moesifmiddleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var bodyEncoders = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate": func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	},
+	"raw-deflate": func(w io.Writer) io.WriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	},
+	"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	"zstd": func(w io.Writer) io.WriteCloser {
+		zw, _ := zstd.NewWriter(w)
+		return zw
+	},
+}
+
+// encode applies encodings to body in order
+func encode(body string, encodings ...string) []byte {
+	b := []byte(body)
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		w := bodyEncoders[encoding](&buf)
+		w.Write(b)
+		w.Close()
+		b = buf.Bytes()
+	}
+	return b
+}
+
+func TestDecodeBody(t *testing.T) {
+	const body = `{"password":"secret","name":"a"}`
+	tests := []struct {
+		name            string
+		encoded         []byte
+		contentEncoding string
+		max             int
+		expected        string
+		truncated       bool
+	}{
+		{"gzip", encode(body, "gzip"), "gzip", 0, body, false},
+		{"x-gzip", encode(body, "gzip"), "x-gzip", 0, body, false},
+		{"deflate", encode(body, "deflate"), "deflate", 0, body, false},
+		{"raw deflate", encode(body, "raw-deflate"), "deflate", 0, body, false},
+		{"brotli", encode(body, "br"), "br", 0, body, false},
+		{"zstd", encode(body, "zstd"), "zstd", 0, body, false},
+		{"stacked", encode(body, "gzip", "br"), "gzip, br", 0, body, false},
+		{"case and identity", encode(body, "gzip"), "identity, GZIP", 0, body, false},
+		{"max size", encode(body, "gzip"), "gzip", 8, body[:8], true},
+	}
+	for _, test := range tests {
+		decoded, truncated, err := decodeBody(test.encoded, test.contentEncoding, test.max)
+		if err != nil || string(decoded) != test.expected || truncated != test.truncated {
+			t.Errorf("%s: got %q truncated=%v err=%v", test.name, decoded, truncated, err)
+		}
+	}
+}
+
+func TestDecodeBodyDefaultLimit(t *testing.T) {
+	encoded := encode(strings.Repeat("a", 4*maxDecodedBodySize), "gzip")
+	decoded, truncated, err := decodeBody(encoded, "gzip", 0)
+	if err != nil || len(decoded) != maxDecodedBodySize || !truncated {
+		t.Errorf("expected %d truncated bytes, got %d truncated=%v err=%v", maxDecodedBodySize, len(decoded), truncated, err)
+	}
+}
+
+func TestDecodeBodyFailures(t *testing.T) {
+	if decoded, _, err := decodeBody([]byte("abc"), "compress", 0); decoded != nil || err == nil {
+		t.Errorf("unsupported encodings should not be decoded, got %q %v", decoded, err)
+	}
+	if decoded, _, err := decodeBody([]byte("abc"), "gzip", 0); decoded != nil || err == nil {
+		t.Errorf("invalid bodies should not be decoded, got %q %v", decoded, err)
+	}
+	if decoded, _, err := decodeBody([]byte("abc"), "identity", 0); decoded != nil || err != nil {
+		t.Errorf("identity bodies should not be decoded, got %q %v", decoded, err)
+	}
+
+	// a body truncated for logging is decoded as far as possible
+	encoded := encode(`{"name":"abcdefghijklmnopqrstuvwxyz"}`, "gzip")
+	decoded, _, err := decodeBody(encoded[:len(encoded)-8], "gzip", 0)
+	if err == nil || string(decoded) != `{"name":"abcdefghijklmnopqrstuvwxyz"}` {
+		t.Errorf("expected the partly decoded body with an error, got %q %v", decoded, err)
+	}
+}
+
+func TestMiddlewareMasksEncodedBody(t *testing.T) {
+	config := NewConfig("app")
+	config.ResponseBodyMasks = func() []string { return []string{"password"} }
+	c, api := newTestClient(config)
+	handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Write(encode(`{"password":"secret","name":"a"}`, "gzip"))
+	}))
+	serve(handler, "GET", "/", "")
+
+	e := api.Events()[0]
+	body, ok := e.Response.Body.(map[string]interface{})
+	if !ok || body["password"] != "*****" || body["name"] != "a" {
+		t.Errorf("expected the decoded body to be masked, got %v", e.Response.Body)
+	}
+	if *e.Response.TransferEncoding != "json" || captureInfo(e)["response_content_encoding"] != "gzip" {
+		t.Errorf("expected a json body with the original encoding recorded, got %v and %v", *e.Response.TransferEncoding, captureInfo(e))
+	}
+}
+
+func TestParseEncodedBodyDecodedTruncation(t *testing.T) {
+	c, _ := newTestClient(NewConfig("app"))
+	header := http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"application/json"}}
+	info := make(map[string]interface{})
+	encoded := encode(`{"password":"secret","padding":"`+strings.Repeat("x", 64)+`"}`, "gzip")
+	body, encoding := c.parseEncodedBody(encoded, false, header, 24, func() []string { return []string{"password"} }, info, "response")
+	if body != nil || encoding != "" || info["response_body_truncated"] != true {
+		t.Errorf("expected no body for the truncated decoded body, got %v %q %v", body, encoding, info)
+	}
+}
@@ -1,8 +1,12 @@
 module github.com/moesif/moesifmiddleware-go
 
-go 1.12
+go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.0.6
+	github.com/klauspost/compress v1.12.3
 	github.com/moesif/moesifapi-go v1.1.5
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
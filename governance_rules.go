@@ -1,11 +1,14 @@
 package moesifmiddleware
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"io"
+	"mime"
+	"net"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -16,7 +19,12 @@ type GovernanceRules struct {
 	Mu      sync.RWMutex
 	Updates chan string
 	eTags   [2]string
+	closed  bool
 	config  GovernanceRulesConfig
+	sources ruleSources
+	cache   *configCache
+	api     moesifapi.API
+	log     Logger
 }
 
 type GovernanceRulesConfig struct {
@@ -25,6 +33,7 @@ type GovernanceRulesConfig struct {
 	CompanyRules []moesifapi.GovernanceRule
 	Regex        []moesifapi.GovernanceRule
 	eTag         string
+	patterns     regexCache
 }
 
 func NewGovernanceRules() GovernanceRules {
@@ -40,7 +49,13 @@ func (g *GovernanceRules) Read() GovernanceRulesConfig {
 	return g.config
 }
 
+// Write replaces the rules, compiling their condition patterns and logging
+// any that are invalid
 func (g *GovernanceRules) Write(config GovernanceRulesConfig) {
+	config.patterns = make(regexCache)
+	compileGovernanceRules(config.patterns, config.UserRules, g.logger())
+	compileGovernanceRules(config.patterns, config.CompanyRules, g.logger())
+	compileGovernanceRules(config.patterns, config.Regex, g.logger())
 	g.Mu.Lock()
 	defer g.Mu.Unlock()
 	g.config = config
@@ -54,10 +69,11 @@ func (g *GovernanceRules) Go() {
 }
 
 func (g *GovernanceRules) Notify(eTag string) {
+	// hold the read lock while sending so that Close cannot close Updates underneath us
 	g.Mu.RLock()
+	defer g.Mu.RUnlock()
 	e := g.eTags
-	g.Mu.RUnlock()
-	if eTag == "" || eTag == e[0] || eTag == e[1] {
+	if g.closed || eTag == "" || eTag == e[0] || eTag == e[1] {
 		return
 	}
 	select {
@@ -66,33 +82,36 @@ func (g *GovernanceRules) Notify(eTag string) {
 	}
 }
 
+// Close stops UpdateLoop. Later notifications are ignored.
+func (g *GovernanceRules) Close() {
+	g.Mu.Lock()
+	defer g.Mu.Unlock()
+	if !g.closed {
+		g.closed = true
+		close(g.Updates)
+	}
+}
+
+func (g *GovernanceRules) logger() Logger {
+	if g.log == nil {
+		return defaultLogger
+	}
+	return g.log
+}
+
 func (g *GovernanceRules) UpdateLoop() {
 	for {
 		eTag, more := <-g.Updates
 		if !more {
 			return
 		}
-		response, err := apiClient.GetGovernanceRules()
+		response, err := g.api.GetGovernanceRules()
 		if err != nil {
-			log.Printf("Failed to get governance rules: %v", err)
+			g.logger().Warn("Failed to get governance rules", "error", err)
 			continue
 		}
-		config := NewGovernanceRulesConfig()
-		config.eTag = response.ETag
-		for _, r := range response.Rules {
-			switch r.Type {
-			case "user":
-				config.UserRules = append(config.UserRules, r)
-				config.EntityRules[r.ID] = r
-			case "company":
-				config.CompanyRules = append(config.CompanyRules, r)
-				config.EntityRules[r.ID] = r
-			case "regex":
-				config.Regex = append(config.Regex, r)
-			}
-		}
-		log.Printf("GovernanceRules.Notify ETag=%s got /rules response ETag=%s", eTag, config.eTag)
-		g.Write(config)
+		g.logger().Info("Got /rules response", "notify_etag", eTag, "etag", response.ETag, "rules", len(response.Rules))
+		g.writeRemote(response.Rules, response.ETag)
 	}
 }
 
@@ -101,6 +120,25 @@ func NewGovernanceRulesConfig() (g GovernanceRulesConfig) {
 	return
 }
 
+// newGovernanceRulesConfigFrom sorts rules into a GovernanceRulesConfig by type
+func newGovernanceRulesConfigFrom(rules []moesifapi.GovernanceRule, eTag string) GovernanceRulesConfig {
+	config := NewGovernanceRulesConfig()
+	config.eTag = eTag
+	for _, r := range rules {
+		switch r.Type {
+		case "user":
+			config.UserRules = append(config.UserRules, r)
+			config.EntityRules[r.ID] = r
+		case "company":
+			config.CompanyRules = append(config.CompanyRules, r)
+			config.EntityRules[r.ID] = r
+		case "regex":
+			config.Regex = append(config.Regex, r)
+		}
+	}
+	return config
+}
+
 type RuleTemplate struct {
 	Rule   moesifapi.GovernanceRule
 	Values map[string]string
@@ -147,6 +185,11 @@ func GetNotMatchingRuleTemplates(rules []moesifapi.GovernanceRule, entityId stri
 }
 
 func (g *GovernanceRules) Get(request *http.Request, userValues, companyValues []EntityRuleValues, userId, companyId string) (rules []RuleTemplate) {
+	return g.get(newRuleLookup(request, 0, g.logger()), userValues, companyValues, userId, companyId)
+}
+
+// get is Get for the request looked up by lookup
+func (g *GovernanceRules) get(lookup *ruleLookup, userValues, companyValues []EntityRuleValues, userId, companyId string) (rules []RuleTemplate) {
 	config := g.Read()
 	// in a list of rules with overrides, the last override value is what will be used in the response
 	// create a slice of rules to check in priority order
@@ -173,7 +216,7 @@ func (g *GovernanceRules) Get(request *http.Request, userValues, companyValues [
 	// the highest priority rules are applied last and thus their value is used in the final response
 	for i := len(regexToCheck) - 1; i >= 0; i-- {
 		r := regexToCheck[i]
-		if CheckRegex(r.Rule, request) {
+		if checkRegex(r.Rule, lookup, config.patterns) {
 			rules = append(rules, r)
 		}
 	}
@@ -185,6 +228,7 @@ type ResponseOverride struct {
 	Override     TemplatedOverrideValues
 	wroteHeaders bool
 	wroteBody    bool
+	hijacked     bool
 }
 
 func NewResponseOverride(response http.ResponseWriter, templates []RuleTemplate) (r ResponseOverride) {
@@ -231,40 +275,156 @@ func (r *ResponseOverride) Write(body []byte) (int, error) {
 	return r.ResponseWriter.Write(body)
 }
 
+// Flush implements http.Flusher, writing the override headers first if needed
+func (r *ResponseOverride) Flush() {
+	if !r.wroteHeaders {
+		r.WriteHeader(200)
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, returning http.ErrNotSupported if the
+// underlying ResponseWriter does not support it
+func (r *ResponseOverride) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher, returning http.ErrNotSupported if the
+// underlying ResponseWriter does not support it
+func (r *ResponseOverride) Push(target string, opts *http.PushOptions) error {
+	if p, ok := r.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// ReadFrom implements io.ReaderFrom, using the underlying ResponseWriter's
+// ReadFrom if it has one
+func (r *ResponseOverride) ReadFrom(src io.Reader) (int64, error) {
+	if r.Override.Block {
+		// blocked responses only write the override body, see Write
+		return io.Copy(writerOnly{r}, src)
+	}
+	r.wroteBody = true
+	if !r.wroteHeaders {
+		r.WriteHeader(200)
+	}
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(r.ResponseWriter, src)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (r *ResponseOverride) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// writerOnly hides any ReadFrom method of the embedded Writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
 func (r *ResponseOverride) finish() {
-	if !r.wroteBody {
+	if !r.wroteBody && !r.hijacked {
 		r.Write([]byte{})
 	}
 }
 
-// bufferRequestBody reads the request body into a buffer and update the request
-// object with a reader containing a copy of the contents so that the request
-// may be used as normal
-func bufferRequestBody(req *http.Request) (body []byte) {
-	newBody, b, err := teeBody(req.Body)
-	if err != nil {
-		log.Printf("Unable to read incoming request body: %v", err)
-		return
+// maxRuleBodySize limits how much of a request body is read to match rule
+// conditions when Max_Request_Body_Size is not set
+const maxRuleBodySize = 1 << 20
+
+// ruleLookup looks up the request values that rule conditions match. The
+// request body is read and parsed at most once, when a condition first needs it.
+type ruleLookup struct {
+	req     *http.Request
+	maxBody int
+	logger  Logger
+
+	bodyRead   bool
+	body       []byte
+	bodyParsed bool
+	bodyValid  bool
+	bodyValue  interface{}
+}
+
+// newRuleLookup returns a ruleLookup for req that reads at most maxBody bytes of
+// its body, or maxRuleBodySize bytes if maxBody is 0
+func newRuleLookup(req *http.Request, maxBody int, logger Logger) *ruleLookup {
+	if maxBody <= 0 {
+		maxBody = maxRuleBodySize
 	}
-	req.Body = newBody
-	body, _ = ioutil.ReadAll(b)
-	return
+	return &ruleLookup{req: req, maxBody: maxBody, logger: logger}
 }
 
-// getJsonKeyString attempts to read a JSON object from input j and
-// if object.key exists and has a string value, it is returned
-func getJsonKeyString(j []byte, key string) (s string) {
-	d := make(map[string]json.RawMessage)
-	if json.Unmarshal(j, &d) == nil {
-		if m, ok := d[key]; ok {
-			json.Unmarshal(m, &s)
-		}
+// requestBody returns the first maxBody bytes of the request body
+func (l *ruleLookup) requestBody() []byte {
+	if !l.bodyRead {
+		l.bodyRead = true
+		l.body = bufferRequestBody(l.req, l.maxBody, l.logger)
 	}
-	return
+	return l.body
+}
+
+// setBody makes body the request body of l, for a request whose body has
+// already been captured and cannot be read again
+func (l *ruleLookup) setBody(body []byte) {
+	l.bodyRead = true
+	l.body = body
+}
+
+// parsedBody returns the request body parsed with parse, and false if it
+// cannot be parsed
+func (l *ruleLookup) parsedBody(parse BodyParser, contentType string) (interface{}, bool) {
+	if !l.bodyParsed {
+		l.bodyParsed = true
+		v, err := parse(l.requestBody(), contentType)
+		l.bodyValue, l.bodyValid = v, err == nil
+	}
+	return l.bodyValue, l.bodyValid
 }
 
-// RequestPathLookup returns the string in a given regexp matching path from req
+// bufferRequestBody reads the first max bytes of the request body into a buffer
+// and updates the request object with a reader of the whole body, so that the
+// request may be used as normal
+func bufferRequestBody(req *http.Request, max int, logger Logger) (body []byte) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	newBody, captured, err := captureBody(req.Body, max)
+	if err != nil {
+		logger.Warn("Unable to read incoming request body", "transaction_id", req.Header.Get("X-Moesif-Transaction-Id"), "error", err)
+		return
+	}
+	req.Body = readCloser{newBody, req.Body}
+	return captured.bytes()
+}
+
+// RequestPathLookup returns the string in a given regexp matching path from req.
+// Paths are request.ip_address, request.route, request.verb,
+// request.headers.<name>, request.query.<name>, and request.body.<path>, where
+// <path> selects a field of a JSON or form body, like "user.tier", "items[0].sku"
+// or "items.0.sku". request.body['a.b'] selects a field whose name has a dot.
+// Numbers and booleans are returned as their JSON text, and objects and arrays
+// as JSON.
 func RequestPathLookup(req *http.Request, path string) string {
+	return newRuleLookup(req, 0, defaultLogger).lookup(path)
+}
+
+// lookup is RequestPathLookup for the request of l
+func (l *ruleLookup) lookup(path string) string {
+	req := l.req
 	switch path {
 	case "request.ip_address":
 		return req.RemoteAddr
@@ -273,22 +433,117 @@ func RequestPathLookup(req *http.Request, path string) string {
 	case "request.verb":
 		return req.Method
 	}
-	const requestBody = "request.body."
-	t := req.Header.Get("Content-Type")
-	if strings.HasPrefix(path, requestBody) && (t == "application/graphql" || t == "application/json") {
-		body := bufferRequestBody(req)
-		key := strings.TrimPrefix(path, requestBody)
-		if t == "application/graphql" && key == "query" {
-			return string(body)
+	const (
+		requestHeaders = "request.headers."
+		requestQuery   = "request.query."
+	)
+	switch {
+	case strings.HasPrefix(path, requestHeaders):
+		return req.Header.Get(strings.TrimPrefix(path, requestHeaders))
+	case strings.HasPrefix(path, requestQuery):
+		return req.URL.Query().Get(strings.TrimPrefix(path, requestQuery))
+	case isBodyPath(path):
+		return l.bodyLookup(strings.TrimPrefix(path[len(requestBodyPath):], "."))
+	}
+	return ""
+}
+
+const requestBodyPath = "request.body"
+
+// isBodyPath reports whether a condition path looks up a field of the request body
+func isBodyPath(path string) bool {
+	return strings.HasPrefix(path, requestBodyPath+".") || strings.HasPrefix(path, requestBodyPath+"[")
+}
+
+// bodyLookup returns the field at key in a JSON, form or multipart form
+// request body, or the whole query of a GraphQL body
+func (l *ruleLookup) bodyLookup(key string) string {
+	contentType := l.req.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	var parse BodyParser
+	switch {
+	case mediaType == "application/graphql":
+		if key == "query" {
+			return string(l.requestBody())
 		}
-		if t == "application/json" {
-			return getJsonKeyString(body, key)
+		return ""
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		parse = parseJSONBody
+	case mediaType == "application/x-www-form-urlencoded":
+		parse = parseFormBody
+	case mediaType == "multipart/form-data":
+		parse = parseMultipartBody
+	default:
+		return ""
+	}
+	steps, err := parseMaskPath(key)
+	if err != nil {
+		l.logger.Debug("Invalid request body path", "path", key, "error", err)
+		return ""
+	}
+	body, ok := l.parsedBody(parse, contentType)
+	if !ok {
+		return ""
+	}
+	return lookupString(body, steps)
+}
+
+// parseJSONBody parses a JSON body, keeping numbers as json.Number
+func parseJSONBody(body []byte, contentType string) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&v)
+	return v, err
+}
+
+// lookupString returns the value at steps in val as a string. A numeric field
+// name indexes an array, and wildcards match nothing.
+func lookupString(val interface{}, steps []maskStep) string {
+	for _, step := range steps {
+		switch v := val.(type) {
+		case map[string]interface{}:
+			if step.index >= 0 || step.wildcard {
+				return ""
+			}
+			val = v[step.name]
+		case []interface{}:
+			index := step.index
+			if n, err := strconv.Atoi(step.name); err == nil && step.index < 0 && !step.wildcard {
+				index = n
+			}
+			if index < 0 || index >= len(v) {
+				return ""
+			}
+			val = v[index]
+		default:
+			return ""
 		}
 	}
-	return ""
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
 }
 
+// CheckRegex reports whether req matches the regex conditions of rule,
+// compiling the condition patterns on each call
 func CheckRegex(rule moesifapi.GovernanceRule, req *http.Request) bool {
+	return checkRegex(rule, newRuleLookup(req, 0, defaultLogger), nil)
+}
+
+// checkRegex is CheckRegex with the patterns compiled when the rules loaded
+func checkRegex(rule moesifapi.GovernanceRule, lookup *ruleLookup, patterns regexCache) bool {
 	// if no regex conditions are specified, the rule matches
 	if len(rule.RegexConfigOr) == 0 {
 		return true
@@ -300,15 +555,19 @@ func CheckRegex(rule moesifapi.GovernanceRule, req *http.Request) bool {
 	for _, regexAnd := range rule.RegexConfigOr {
 		andValue := true
 		for _, c := range regexAnd.Conditions {
-			s := RequestPathLookup(req, c.Path)
+			s := lookup.lookup(c.Path)
 			// c.Value is a regular expression, but if it contains an error, default to false.
 			// False here will fail to match the rule which errors on the side of propagating the event
 			// rather than a regex error potentially causing a rule to match
-			match, err := regexp.MatchString(c.Value, s)
+			match, err := patterns.match(c.Value, s)
 			if err != nil {
-				log.Printf(`Governance rule regexp error: org-app=%s-%s rule.id=%s rule.name="%s" path=%s regexp="%s"`, rule.OrgID, rule.AppID, rule.ID, rule.Name, c.Path, c.Value)
+				lookup.logger.Error("Governance rule regexp error", "org_id", rule.OrgID, "app_id", rule.AppID, "rule_id", rule.ID, "rule_name", rule.Name, "path", c.Path, "regexp", c.Value)
+			}
+			if !match {
+				// the remaining conditions cannot make the inner slice true
+				andValue = false
+				break
 			}
-			andValue = andValue && match
 		}
 		if andValue {
 			return true
@@ -0,0 +1,281 @@
+package moesifmiddleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+func ruleWith(path, value string) moesifapi.GovernanceRule {
+	return moesifapi.GovernanceRule{RegexConfigOr: []moesifapi.RegexConditionsAnd{
+		{Conditions: []moesifapi.RegexCondition{{Path: path, Value: value}}},
+	}}
+}
+
+func newRuleRequest(contentType, body string) *http.Request {
+	request := httptest.NewRequest("POST", "/items?plan=pro&tags=a&tags=b", strings.NewReader(body))
+	request.Header.Set("X-Api-Key", "key-123")
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return request
+}
+
+func TestCheckRegexPaths(t *testing.T) {
+	const jsonBody = `{"user":{"tier":"gold","age":42,"ratio":0.5,"admin":true,"manager":null},"items":[{"sku":"a1"},{"sku":"b2","qty":3}],"a.b":"dotted"}`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		path        string
+		value       string
+		expected    bool
+	}{
+		{"route", "", "", "request.route", "^/items$", true},
+		{"verb", "", "", "request.verb", "^POST$", true},
+		{"ip address", "", "", "request.ip_address", "^192\\.0\\.2\\.1", true},
+		{"header", "", "", "request.headers.X-Api-Key", "^key-123$", true},
+		{"header ignores case", "", "", "request.headers.x-api-key", "^key-123$", true},
+		{"missing header", "", "", "request.headers.X-Other", "^$", true},
+		{"query parameter", "", "", "request.query.plan", "^pro$", true},
+		{"repeated query parameter", "", "", "request.query.tags", "^a$", true},
+		{"missing query parameter", "", "", "request.query.page", ".", false},
+		{"top level json field", "application/json", `{"plan":"pro"}`, "request.body.plan", "^pro$", true},
+		{"json with charset", "application/json; charset=utf-8", `{"plan":"pro"}`, "request.body.plan", "^pro$", true},
+		{"json suffix", "application/vnd.api+json", `{"plan":"pro"}`, "request.body.plan", "^pro$", true},
+		{"nested json field", "application/json", jsonBody, "request.body.user.tier", "^gold$", true},
+		{"json array index", "application/json", jsonBody, "request.body.items[1].sku", "^b2$", true},
+		{"json dotted array index", "application/json", jsonBody, "request.body.items.0.sku", "^a1$", true},
+		{"json index out of range", "application/json", jsonBody, "request.body.items[2].sku", ".", false},
+		{"json quoted name", "application/json", jsonBody, "request.body['a.b']", "^dotted$", true},
+		{"json integer", "application/json", jsonBody, "request.body.user.age", "^42$", true},
+		{"json number", "application/json", jsonBody, "request.body.user.ratio", "^0\\.5$", true},
+		{"json boolean", "application/json", jsonBody, "request.body.user.admin", "^true$", true},
+		{"json null", "application/json", jsonBody, "request.body.user.manager", ".", false},
+		{"json object", "application/json", jsonBody, "request.body.items[1]", `"qty":3`, true},
+		{"json wildcard", "application/json", jsonBody, "request.body.items[*].sku", ".", false},
+		{"invalid json", "application/json", `{"plan":`, "request.body.plan", ".", false},
+		{"form field", "application/x-www-form-urlencoded", "plan=pro&seats=10", "request.body.seats", "^10$", true},
+		{"repeated form field", "application/x-www-form-urlencoded", "tag=a&tag=b", "request.body.tag[1]", "^b$", true},
+		{"graphql query", "application/graphql", "{ items { sku } }", "request.body.query", "items", true},
+		{"unsupported body", "text/plain", "plan=pro", "request.body.plan", ".", false},
+		{"unknown path", "", "", "request.unknown", ".", false},
+	}
+	for _, test := range tests {
+		request := newRuleRequest(test.contentType, test.body)
+		if match := CheckRegex(ruleWith(test.path, test.value), request); match != test.expected {
+			t.Errorf("%s: %s =~ %s got %v", test.name, test.path, test.value, match)
+		}
+		// the body can still be read after the lookup
+		if body, _ := ioutil.ReadAll(request.Body); string(body) != test.body {
+			t.Errorf("%s: handler would read %q", test.name, body)
+		}
+	}
+}
+
+func TestCheckRegexMultipartField(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("plan", "pro")
+	file, _ := w.CreateFormFile("upload", "report.csv")
+	file.Write([]byte("a,b\n"))
+	w.Close()
+
+	for path, value := range map[string]string{
+		"request.body.plan":            "^pro$",
+		"request.body.upload.filename": "^report\\.csv$",
+		"request.body.upload.size":     "^4$",
+	} {
+		request := newRuleRequest(w.FormDataContentType(), body.String())
+		if !CheckRegex(ruleWith(path, value), request) {
+			t.Errorf("%s did not match %s", path, value)
+		}
+	}
+}
+
+func TestRuleLookupReadsBodyOnce(t *testing.T) {
+	g := NewGovernanceRules()
+	config := NewGovernanceRulesConfig()
+	config.Regex = []moesifapi.GovernanceRule{
+		ruleWith("request.body.plan", "^pro$"),
+		ruleWith("request.body.seats", "^10$"),
+		ruleWith("request.body.plan", "^free$"),
+	}
+	g.Write(config)
+	request := newRuleRequest("application/json", `{"plan":"pro","seats":10}`)
+	original := request.Body
+	if rules := g.Get(request, nil, nil, "", ""); len(rules) != 2 {
+		t.Errorf("expected 2 rules to match, got %v", rules)
+	}
+	if wrapped, ok := request.Body.(readCloser); !ok || wrapped.Closer != original {
+		t.Errorf("expected the body to be buffered once, got %#v", request.Body)
+	}
+}
+
+func TestRuleLookupBodyLimit(t *testing.T) {
+	const body = `{"plan":"pro","seats":10}`
+	request := newRuleRequest("application/json", body)
+	lookup := newRuleLookup(request, 8, defaultLogger)
+	if value := lookup.lookup("request.body.plan"); value != "" {
+		t.Errorf("a truncated body should not be parsed, got %q", value)
+	}
+	if read, _ := ioutil.ReadAll(request.Body); string(read) != body {
+		t.Errorf("handler would read %q", read)
+	}
+}
+
+// errorLogger counts Error messages
+type errorLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *errorLogger) Debug(string, ...interface{}) {}
+func (l *errorLogger) Info(string, ...interface{})  {}
+func (l *errorLogger) Warn(string, ...interface{})  {}
+func (l *errorLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, msg)
+}
+
+func TestInvalidRulePatternReportedOnLoad(t *testing.T) {
+	logger := &errorLogger{}
+	g := NewGovernanceRules()
+	g.log = logger
+	config := NewGovernanceRulesConfig()
+	invalid := ruleWith("request.route", "(")
+	invalid.ID = "invalid"
+	invalid.Block = true
+	config.Regex = []moesifapi.GovernanceRule{invalid, ruleWith("request.route", "^/items")}
+	g.Write(config)
+	if len(logger.errors) != 1 {
+		t.Fatalf("expected the invalid rule to be reported once on load, got %v", logger.errors)
+	}
+
+	for i := 0; i < 3; i++ {
+		rules := g.Get(newRuleRequest("", ""), nil, nil, "", "")
+		if len(rules) != 1 || rules[0].Rule.ID == "invalid" {
+			t.Errorf("expected only the valid rule to match, got %v", rules)
+		}
+	}
+	if len(logger.errors) != 1 {
+		t.Errorf("expected no errors while evaluating rules, got %v", logger.errors)
+	}
+}
+
+func TestInvalidSamplingPatternReportedOnLoad(t *testing.T) {
+	logger := &errorLogger{}
+	a := NewAppConfig()
+	a.log = logger
+	config := NewAppConfigResponse()
+	config.RegexConfig = []RegexRule{{Conditions: []RegexCondition{{Path: "request.route", Value: "["}}, SampleRate: 0}}
+	a.Write(config)
+	for i := 0; i < 3; i++ {
+		if rate := a.getSamplingPercentage(newRuleLookup(newRuleRequest("", ""), 0, logger), "", ""); rate != 100 {
+			t.Errorf("got sample rate %d from an invalid rule", rate)
+		}
+	}
+	if len(logger.errors) != 1 {
+		t.Errorf("expected the invalid rule to be reported once on load, got %v", logger.errors)
+	}
+}
+
+// benchmarkRules returns n regex rules on distinct routes, none of which match
+// the benchmark request
+func benchmarkRules(n int) []moesifapi.GovernanceRule {
+	rules := make([]moesifapi.GovernanceRule, n)
+	for i := range rules {
+		rules[i] = moesifapi.GovernanceRule{
+			ID: fmt.Sprint(i),
+			RegexConfigOr: []moesifapi.RegexConditionsAnd{{Conditions: []moesifapi.RegexCondition{
+				{Path: "request.verb", Value: "^(GET|POST)$"},
+				{Path: "request.route", Value: fmt.Sprintf(`^/v1/resource%d/[0-9]+$`, i)},
+			}}},
+		}
+	}
+	return rules
+}
+
+func BenchmarkGovernanceRulesGet(b *testing.B) {
+	for _, n := range []int{100, 500} {
+		g := NewGovernanceRules()
+		config := NewGovernanceRulesConfig()
+		config.Regex = benchmarkRules(n)
+		g.Write(config)
+		request := httptest.NewRequest("GET", "/v1/other/1", nil)
+		b.Run(fmt.Sprintf("%d rules", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.Get(request, nil, nil, "", "")
+			}
+		})
+	}
+}
+
+// benchmarkBodyRules returns n regex rules on a request body field, none of
+// which match the benchmark request
+func benchmarkBodyRules(n int) []moesifapi.GovernanceRule {
+	rules := make([]moesifapi.GovernanceRule, n)
+	for i := range rules {
+		rules[i] = ruleWith("request.body.user.tier", fmt.Sprintf("^tier%d$", i))
+	}
+	return rules
+}
+
+func BenchmarkGovernanceRulesGetBody(b *testing.B) {
+	const body = `{"user":{"id":"u1","tier":"gold"},"items":[{"sku":"a1","qty":1},{"sku":"b2","qty":3}]}`
+	for _, n := range []int{100, 500} {
+		g := NewGovernanceRules()
+		config := NewGovernanceRulesConfig()
+		config.Regex = benchmarkBodyRules(n)
+		g.Write(config)
+		b.Run(fmt.Sprintf("%d rules", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.Get(newRuleRequest("application/json", body), nil, nil, "", "")
+			}
+		})
+	}
+}
+
+// BenchmarkCheckRegex compiles the patterns on every call, for comparison
+func BenchmarkCheckRegex(b *testing.B) {
+	for _, n := range []int{100, 500} {
+		rules := benchmarkRules(n)
+		request := httptest.NewRequest("GET", "/v1/other/1", nil)
+		b.Run(fmt.Sprintf("%d rules", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, rule := range rules {
+					CheckRegex(rule, request)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetSamplingPercentage(b *testing.B) {
+	for _, n := range []int{100, 500} {
+		a := NewAppConfig()
+		config := NewAppConfigResponse()
+		for i := 0; i < n; i++ {
+			config.RegexConfig = append(config.RegexConfig, RegexRule{
+				Conditions: []RegexCondition{{Path: "request.route", Value: fmt.Sprintf(`^/v1/resource%d/`, i)}},
+				SampleRate: 10,
+			})
+		}
+		a.Write(config)
+		request := httptest.NewRequest("GET", "/v1/other/1", nil)
+		b.Run(fmt.Sprintf("%d rules", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				a.getSamplingPercentage(newRuleLookup(request, 0, defaultLogger), "", "")
+			}
+		})
+	}
+}
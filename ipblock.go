@@ -0,0 +1,164 @@
+package moesifmiddleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipBlockList holds the addresses and CIDR ranges of the
+// ip_addresses_blocked_by_name app config, with the name each is blocked by
+type ipBlockList struct {
+	addrs    map[string]string
+	prefixes []ipBlockPrefix
+}
+
+type ipBlockPrefix struct {
+	prefix *net.IPNet
+	name   string
+}
+
+// newIPBlockList parses blocked, which maps addresses or CIDR ranges to names.
+// Entries whose key is not an address or range are read the other way round,
+// from name to address, and entries that are neither are ignored.
+func newIPBlockList(blocked map[string]string) ipBlockList {
+	l := ipBlockList{addrs: make(map[string]string)}
+	for key, value := range blocked {
+		if !l.add(key, value) {
+			l.add(value, key)
+		}
+	}
+	return l
+}
+
+func (l *ipBlockList) add(ip, name string) bool {
+	ip = strings.TrimSpace(ip)
+	if strings.Contains(ip, "/") {
+		_, prefix, err := net.ParseCIDR(ip)
+		if err != nil {
+			return false
+		}
+		if ones, bits := prefix.Mask.Size(); bits == 8*net.IPv6len && ones >= 96 && prefix.IP.To4() != nil {
+			prefix = &net.IPNet{IP: prefix.IP.To4(), Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+		}
+		l.prefixes = append(l.prefixes, ipBlockPrefix{prefix, name})
+		return true
+	}
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return false
+	}
+	l.addrs[addr.String()] = name
+	return true
+}
+
+// newTrustedProxies parses the Trusted_Proxies addresses and CIDR ranges
+func newTrustedProxies(proxies []string) ipBlockList {
+	l := newIPBlockList(nil)
+	for _, proxy := range proxies {
+		l.add(proxy, "trusted proxy")
+	}
+	return l
+}
+
+// empty reports whether l holds no addresses or ranges
+func (l ipBlockList) empty() bool {
+	return len(l.addrs) == 0 && len(l.prefixes) == 0
+}
+
+// match returns the name ip is blocked by, and false if it is not blocked.
+// ip may include a port, as in http.Request.RemoteAddr.
+func (l ipBlockList) match(ip string) (string, bool) {
+	addr, ok := parseClientAddr(ip)
+	if !ok {
+		return "", false
+	}
+	if name, ok := l.addrs[addr.String()]; ok {
+		return name, true
+	}
+	for _, p := range l.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.name, true
+		}
+	}
+	return "", false
+}
+
+// parseClientAddr parses an IPv4 or IPv6 address with or without a port,
+// converting IPv4-mapped IPv6 addresses to IPv4
+func parseClientAddr(ip string) (net.IP, bool) {
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return parseAddr(ip)
+}
+
+// parseAddr parses an IPv4 or IPv6 address without a port, dropping any IPv6
+// zone and converting IPv4-mapped IPv6 addresses to IPv4
+func parseAddr(ip string) (net.IP, bool) {
+	if zone := strings.IndexByte(ip, '%'); zone >= 0 {
+		ip = ip[:zone]
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, false
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	return addr, true
+}
+
+// blockingIP returns the address IP blocks apply to for request: the connecting
+// address or, if that is a Trusted_Proxies address, the last X-Forwarded-For
+// address that is not. Unlike getClientIp, it ignores headers set by clients
+// that do not connect through a trusted proxy.
+func (c *Client) blockingIP(request *http.Request) string {
+	c.warnUntrustedForwarding(request)
+	ip := request.RemoteAddr
+	if _, trusted := c.trustedProxies.match(ip); trusted {
+		// each proxy appends the address it received the request from
+		hops := strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, ok := parseClientAddr(hop); !ok {
+				break
+			}
+			ip = hop
+			if _, trusted := c.trustedProxies.match(hop); !trusted {
+				break
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// warnUntrustedForwarding logs once that IP blocks ignore X-Forwarded-For when
+// they apply to a request that has it and no Trusted_Proxies are set, since the
+// server is then likely behind a proxy whose address IP blocks see instead
+func (c *Client) warnUntrustedForwarding(request *http.Request) {
+	if !c.trustedProxies.empty() || len(request.Header["X-Forwarded-For"]) == 0 || !c.appConfig.blocksIPs() {
+		return
+	}
+	c.forwardingWarning.Do(func() {
+		c.logger.Warn("IP blocks apply to the connecting address and ignore X-Forwarded-For, set Trusted_Proxies if the server is behind a proxy", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "remote_addr", request.RemoteAddr)
+	})
+}
+
+// blockedIPOverride returns the response for requests from blocked addresses,
+// the Blocked_IP_Response option with a 403 status if it sets none
+func (c *Client) blockedIPOverride() TemplatedOverrideValues {
+	o := c.config.BlockedIPResponse
+	o.Block = true
+	if o.Status == 0 {
+		o.Status = http.StatusForbidden
+	}
+	if o.Headers == nil {
+		o.Headers = make(map[string]string)
+	}
+	return o
+}
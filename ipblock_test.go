@@ -0,0 +1,200 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPBlockList(t *testing.T) {
+	l := newIPBlockList(map[string]string{
+		"203.0.113.7":          "abuser",
+		"10.0.0.0/8":           "internal",
+		"2001:db8::/32":        "documentation",
+		"::1":                  "loopback",
+		"by name":              "198.51.100.1",
+		"::ffff:192.0.2.0/120": "mapped",
+		"not an address":       "ignored",
+	})
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{"203.0.113.7", "abuser"},
+		{"203.0.113.7:51234", "abuser"},
+		{"10.1.2.3", "internal"},
+		{"2001:db8:1::5", "documentation"},
+		{"[2001:db8::5]:443", "documentation"},
+		{"::1", "loopback"},
+		{"::ffff:203.0.113.7", "abuser"},
+		{"192.0.2.9", "mapped"},
+		{"198.51.100.1", "by name"},
+		{"203.0.113.8", ""},
+		{"2001:db9::1", ""},
+		{"", ""},
+		{"unknown", ""},
+	}
+	for _, test := range tests {
+		name, blocked := l.match(test.ip)
+		if name != test.name || blocked != (test.name != "") {
+			t.Errorf("%q: got %q, blocked=%v", test.ip, name, blocked)
+		}
+	}
+}
+
+func TestGetClientIpFromXForwardedForIPv6(t *testing.T) {
+	for header, expected := range map[string]string{
+		"2001:db8::1, 10.0.0.1":     "2001:db8::1",
+		"[2001:db8::1]:443":         "2001:db8::1",
+		"unknown, 203.0.113.7:8080": "203.0.113.7",
+	} {
+		if ip := getClientIpFromXForwardedFor(header); ip != expected {
+			t.Errorf("%q: got %q, expected %q", header, ip, expected)
+		}
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		response TemplatedOverrideValues
+		status   int
+		body     string
+	}{
+		{"default response", TemplatedOverrideValues{}, http.StatusForbidden, ""},
+		{"configured response", TemplatedOverrideValues{
+			Status:  http.StatusUnauthorized,
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    []byte(`{"error":"blocked"}`),
+		}, http.StatusUnauthorized, `{"error":"blocked"}`},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.BlockedIPResponse = test.response
+		config.TrustedProxies = []string{"192.0.2.0/24"}
+		c, api := newTestClient(config)
+		appConfig := NewAppConfigResponse()
+		appConfig.IPAddressesBlockedByName = map[string]string{"2001:db8::/32": "documentation"}
+		c.appConfig.Write(appConfig)
+
+		served := false
+		handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			served = true
+		}))
+		request := httptest.NewRequest("GET", "/items", nil)
+		request.Header.Set("X-Forwarded-For", "2001:db8::7")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if served || response.Code != test.status || response.Body.String() != test.body {
+			t.Errorf("%s: got %d %q, served=%v", test.name, response.Code, response.Body, served)
+		}
+		if ct := response.Header().Get("Content-Type"); ct != test.response.Headers["Content-Type"] {
+			t.Errorf("%s: got Content-Type %q", test.name, ct)
+		}
+
+		events := api.Events()
+		if len(events) != 1 {
+			t.Fatalf("%s: expected one event, got %d", test.name, len(events))
+		}
+		blocked, _ := captureInfo(events[0])["blocked"].(map[string]interface{})
+		if blocked["reason"] != "ip_address" || blocked["name"] != "documentation" || blocked["ip_address"] != "2001:db8::7" {
+			t.Errorf("%s: got block reason %v", test.name, blocked)
+		}
+		if events[0].Response.Status != test.status {
+			t.Errorf("%s: event has status %d", test.name, events[0].Response.Status)
+		}
+	}
+
+	// other addresses are served
+	c, _ := newTestClient(NewConfig("app"))
+	appConfig := NewAppConfigResponse()
+	appConfig.IPAddressesBlockedByName = map[string]string{"2001:db8::/32": "documentation"}
+	c.appConfig.Write(appConfig)
+	if response := serve(c.Middleware(echo), "GET", "/items", ""); response.Code != http.StatusOK {
+		t.Errorf("unblocked request got %d", response.Code)
+	}
+}
+
+// warnLogger records warnings
+type warnLogger struct {
+	errorLogger
+	warnings []string
+}
+
+func (l *warnLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, msg)
+}
+
+func TestWarnUntrustedForwarding(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		blocked        map[string]string
+		forwardedFor   string
+		warnings       int
+	}{
+		{"blocks without trusted proxies", nil, map[string]string{"203.0.113.0/24": "abusers"}, "203.0.113.7", 1},
+		{"no X-Forwarded-For", nil, map[string]string{"203.0.113.0/24": "abusers"}, "", 0},
+		{"no blocks", nil, nil, "203.0.113.7", 0},
+		{"trusted proxies", []string{"10.0.0.0/8"}, map[string]string{"203.0.113.0/24": "abusers"}, "203.0.113.7", 0},
+	}
+	for _, test := range tests {
+		logger := &warnLogger{}
+		config := NewConfig("app")
+		config.Logger = logger
+		config.TrustedProxies = test.trustedProxies
+		c, _ := newTestClient(config)
+		appConfig := NewAppConfigResponse()
+		appConfig.IPAddressesBlockedByName = test.blocked
+		c.appConfig.Write(appConfig)
+		for i := 0; i < 3; i++ {
+			request := httptest.NewRequest("GET", "/items", nil)
+			if test.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+			c.Middleware(echo).ServeHTTP(httptest.NewRecorder(), request)
+		}
+		if len(logger.warnings) != test.warnings {
+			t.Errorf("%s: expected %d warnings, got %v", test.name, test.warnings, logger.warnings)
+		}
+	}
+}
+
+func TestBlockingIPIgnoresClientHeaders(t *testing.T) {
+	config := NewConfig("app")
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	c, _ := newTestClient(config)
+	appConfig := NewAppConfigResponse()
+	appConfig.IPAddressesBlockedByName = map[string]string{"203.0.113.0/24": "abusers"}
+	c.appConfig.Write(appConfig)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		blocked    bool
+	}{
+		{"blocked client", "203.0.113.7:51234", nil, true},
+		{"spoofed X-Client-Ip", "203.0.113.7:51234", map[string]string{"X-Client-Ip": "1.1.1.1"}, true},
+		{"spoofed X-Forwarded-For", "203.0.113.7:51234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, true},
+		{"header from an untrusted client", "198.51.100.1:51234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, false},
+		{"through a trusted proxy", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "203.0.113.7"}, true},
+		{"through trusted proxies", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.2"}, true},
+		{"spoofed through a trusted proxy", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.7", "X-Client-Ip": "1.1.1.1"}, true},
+		{"allowed through a trusted proxy", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "203.0.113.7, 198.51.100.1"}, false},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/items", nil)
+		request.RemoteAddr = test.remoteAddr
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		response := httptest.NewRecorder()
+		c.Middleware(echo).ServeHTTP(response, request)
+		if blocked := response.Code == http.StatusForbidden; blocked != test.blocked {
+			t.Errorf("%s: got %d", test.name, response.Code)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package moesifmiddleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moesif/moesifapi-go"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultLocalConfigReload is how often local config files are checked for
+// changes if Config_File_Reload_Seconds is not set
+const defaultLocalConfigReload = 5 * time.Second
+
+// readConfigFile reads a JSON or YAML file as JSON. Files ending in .yaml or
+// .yml are YAML, and others are JSON.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return data, nil
+}
+
+// localFile is a config file that is loaded again when it changes
+type localFile struct {
+	path    string
+	load    func(data []byte) error
+	modTime time.Time
+	size    int64
+}
+
+// check loads the file if it changed since it was last loaded, keeping the
+// previous contents if it cannot be read or loaded
+func (f *localFile) check(logger Logger) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		logger.Warn("Unable to read local config file", "path", f.path, "error", err)
+		return
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return
+	}
+	data, err := readConfigFile(f.path)
+	if err == nil {
+		err = f.load(data)
+	}
+	if err != nil {
+		logger.Warn("Unable to load local config file", "path", f.path, "error", err)
+		return
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	logger.Info("Loaded local config file", "path", f.path)
+}
+
+// localFiles are the App_Config_File and Governance_Rules_File files of a client
+type localFiles struct {
+	files []*localFile
+	log   Logger
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// loadLocalFiles loads the App_Config_File and Governance_Rules_File options
+// into the client's AppConfig and GovernanceRules, or returns nil if neither is
+// set
+func (c *Client) loadLocalFiles() *localFiles {
+	l := &localFiles{log: c.logger, stop: make(chan struct{})}
+	if path := c.config.AppConfigFile; path != "" {
+		c.appConfig.sources.replace = c.config.ReplaceRemoteConfig
+		l.files = append(l.files, &localFile{path: path, load: c.appConfig.writeLocal})
+	}
+	if path := c.config.GovernanceRulesFile; path != "" {
+		c.governanceRules.sources.replace = c.config.ReplaceRemoteConfig
+		l.files = append(l.files, &localFile{path: path, load: c.governanceRules.writeLocal})
+	}
+	if len(l.files) == 0 {
+		return nil
+	}
+	l.check()
+	return l
+}
+
+// check loads the files that changed since they were last loaded
+func (l *localFiles) check() {
+	for _, f := range l.files {
+		f.check(l.log)
+	}
+}
+
+// watch checks the files for changes every interval until close is called
+func (l *localFiles) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.check()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// close stops watch. It is safe to call on a nil localFiles.
+func (l *localFiles) close() {
+	if l != nil {
+		l.once.Do(func() { close(l.stop) })
+	}
+}
+
+// appConfigSources are the remote app config and the local app config file
+// that make up an AppConfig
+type appConfigSources struct {
+	sync.Mutex
+	remote    AppConfigResponse
+	hasRemote bool
+	local     []byte // JSON
+	replace   bool
+}
+
+// writeRemote writes config from the /config endpoint, with the local config
+// file applied over it, and saves it to the config cache
+func (c *AppConfig) writeRemote(config AppConfigResponse) {
+	c.cache.saveAppConfig(config)
+	c.setRemote(config)
+}
+
+// setRemote writes config as the remote config, with the local config file
+// applied over it
+func (c *AppConfig) setRemote(config AppConfigResponse) {
+	c.sources.Lock()
+	defer c.sources.Unlock()
+	c.sources.remote, c.sources.hasRemote = config, true
+	c.writeSources()
+}
+
+// writeLocal writes the local config file data, in JSON, over the remote config
+func (c *AppConfig) writeLocal(data []byte) error {
+	var config AppConfigResponse
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	c.sources.Lock()
+	defer c.sources.Unlock()
+	c.sources.local = data
+	c.writeSources()
+	return nil
+}
+
+// writeSources writes the config made up of the remote config and the local
+// config file. The fields the local file sets replace those of the remote
+// config, except that user and company sample rates and rules, blocked IP
+// addresses and billing configs are merged with the remote ones by key. If
+// replace is set, the local file is used alone. c.sources must be locked.
+func (c *AppConfig) writeSources() {
+	s := &c.sources
+	if s.local == nil {
+		c.Write(s.remote)
+		return
+	}
+	config := NewAppConfigResponse()
+	if s.hasRemote && !s.replace {
+		// copy the remote config so that merging local maps into it does not
+		// modify the maps of the remote config
+		remote, _ := json.Marshal(s.remote)
+		json.Unmarshal(remote, &config)
+		config.eTag = s.remote.eTag
+	}
+	json.Unmarshal(s.local, &config)
+	c.Write(config)
+}
+
+// ruleSources are the remote rules and the rules of the local governance rules
+// file that make up GovernanceRules
+type ruleSources struct {
+	sync.Mutex
+	remote     []moesifapi.GovernanceRule
+	remoteETag string
+	local      []moesifapi.GovernanceRule
+	hasLocal   bool
+	replace    bool
+}
+
+// writeRemote writes rules from the /rules endpoint, merged with the local
+// rules, and saves them to the config cache
+func (g *GovernanceRules) writeRemote(rules []moesifapi.GovernanceRule, eTag string) {
+	g.cache.saveRules(rules, eTag)
+	g.setRemote(rules, eTag)
+}
+
+// setRemote writes rules as the remote rules, merged with the local rules
+func (g *GovernanceRules) setRemote(rules []moesifapi.GovernanceRule, eTag string) {
+	g.sources.Lock()
+	defer g.sources.Unlock()
+	g.sources.remote, g.sources.remoteETag = rules, eTag
+	g.writeSources()
+}
+
+// writeLocal writes the local governance rules file data, a JSON array of
+// rules, merged with the remote rules
+func (g *GovernanceRules) writeLocal(data []byte) error {
+	var rules []moesifapi.GovernanceRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	g.sources.Lock()
+	defer g.sources.Unlock()
+	g.sources.local, g.sources.hasLocal = rules, true
+	g.writeSources()
+	return nil
+}
+
+// writeSources writes the remote rules together with the local rules, which
+// replace remote rules with the same id. If replace is set, the local rules
+// are used alone. g.sources must be locked.
+func (g *GovernanceRules) writeSources() {
+	s := &g.sources
+	if !s.hasLocal {
+		g.Write(newGovernanceRulesConfigFrom(s.remote, s.remoteETag))
+		return
+	}
+	if s.replace {
+		g.Write(newGovernanceRulesConfigFrom(s.local, ""))
+		return
+	}
+	local := make(map[string]bool, len(s.local))
+	for _, r := range s.local {
+		local[r.ID] = true
+	}
+	var rules []moesifapi.GovernanceRule
+	for _, r := range s.remote {
+		if !local[r.ID] {
+			rules = append(rules, r)
+		}
+	}
+	rules = append(rules, s.local...)
+	g.Write(newGovernanceRulesConfigFrom(rules, s.remoteETag))
+}
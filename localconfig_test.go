@@ -0,0 +1,154 @@
+package moesifmiddleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+func writeFile(t *testing.T, path, data string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const localRulesYAML = `
+- _id: block-items
+  type: regex
+  block: true
+  regex_config:
+    - conditions:
+        - path: request.route
+          value: ^/items
+  response:
+    status: 403
+    body: {"error": "blocked"}
+`
+
+func TestLocalGovernanceRulesFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "rules.yaml")
+	writeFile(t, path, localRulesYAML, time.Now().Add(-time.Minute))
+	config := NewConfig("app")
+	config.GovernanceRulesFile = path
+	config.ConfigFileReloadSeconds = -1 // checked below
+	c, _ := newTestClient(config)
+
+	response := serve(c.Middleware(echo), "GET", "/items", "")
+	if response.Code != http.StatusForbidden || response.Body.String() != `{"error":"blocked"}` {
+		t.Errorf("got %d %q from a local rule", response.Code, response.Body)
+	}
+
+	// an invalid file keeps the loaded rules
+	writeFile(t, path, "- [", time.Now().Add(-time.Second))
+	c.local.check()
+	if response := serve(c.Middleware(echo), "GET", "/items", ""); response.Code != http.StatusForbidden {
+		t.Errorf("got %d after loading an invalid file", response.Code)
+	}
+
+	// changes are reloaded
+	writeFile(t, path, "[]", time.Now())
+	c.local.check()
+	if response := serve(c.Middleware(echo), "GET", "/items", ""); response.Code != http.StatusOK {
+		t.Errorf("got %d after the rule was removed", response.Code)
+	}
+}
+
+func regexRule(id, route string) moesifapi.GovernanceRule {
+	rule := ruleWith("request.route", route)
+	rule.ID = id
+	rule.Type = "regex"
+	return rule
+}
+
+func TestLocalGovernanceRulesMerge(t *testing.T) {
+	for _, replace := range []bool{false, true} {
+		g := NewGovernanceRules()
+		g.sources.replace = replace
+		g.writeRemote([]moesifapi.GovernanceRule{regexRule("a", "^/remote-a"), regexRule("b", "^/remote-b")}, "etag")
+		if err := g.writeLocal([]byte(`[{"_id":"b","type":"regex","regex_config":[{"conditions":[{"path":"request.route","value":"^/local-b"}]}]},{"_id":"c","type":"regex"}]`)); err != nil {
+			t.Fatal(err)
+		}
+		routes := make(map[string]string)
+		for _, r := range g.Read().Regex {
+			routes[r.ID] = ""
+			if len(r.RegexConfigOr) > 0 {
+				routes[r.ID] = r.RegexConfigOr[0].Conditions[0].Value
+			}
+		}
+		expected := map[string]string{"a": "^/remote-a", "b": "^/local-b", "c": ""}
+		if replace {
+			expected = map[string]string{"b": "^/local-b", "c": ""}
+		}
+		if !reflect.DeepEqual(routes, expected) {
+			t.Errorf("replace=%v: got %v, expected %v", replace, routes, expected)
+		}
+
+		// later remote rules are merged with the local rules too
+		g.writeRemote([]moesifapi.GovernanceRule{regexRule("d", "^/remote-d")}, "etag2")
+		if _, ok := ruleIds(&g)["d"]; ok == replace {
+			t.Errorf("replace=%v: got %v after a remote update", replace, ruleIds(&g))
+		}
+	}
+}
+
+func ruleIds(g *GovernanceRules) map[string]bool {
+	ids := make(map[string]bool)
+	for _, r := range g.Read().Regex {
+		ids[r.ID] = true
+	}
+	return ids
+}
+
+func TestLocalAppConfigMerge(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "config.json")
+	writeFile(t, path, `{"sample_rate": 10, "user_sample_rate": {"u2": 5}, "ip_addresses_blocked_by_name": {"10.0.0.0/8": "internal"}}`, time.Now())
+	for _, replace := range []bool{false, true} {
+		config := NewConfig("app")
+		config.AppConfigFile = path
+		config.ReplaceRemoteConfig = replace
+		c, _ := newTestClient(config)
+		remote := NewAppConfigResponse()
+		remote.SampleRate = 50
+		remote.UserSampleRate = map[string]int{"u1": 20}
+		remote.CompanySampleRate = map[string]int{"c1": 30}
+		c.appConfig.writeRemote(remote)
+
+		merged := c.appConfig.Read()
+		expected := map[string]int{"u1": 20, "u2": 5}
+		companies := map[string]int{"c1": 30}
+		if replace {
+			expected = map[string]int{"u2": 5}
+			companies = nil
+		}
+		if merged.SampleRate != 10 || !reflect.DeepEqual(merged.UserSampleRate, expected) || !reflect.DeepEqual(merged.CompanySampleRate, companies) {
+			t.Errorf("replace=%v: got %+v", replace, merged)
+		}
+		if len(remote.UserSampleRate) != 1 {
+			t.Errorf("replace=%v: the remote config was modified: %v", replace, remote.UserSampleRate)
+		}
+		if name, blocked := c.appConfig.BlockedIP("10.1.1.1"); !blocked || name != "internal" {
+			t.Errorf("replace=%v: local blocked IP addresses not applied", replace)
+		}
+	}
+}
+
+func TestReplaceRemoteConfigRequiresFile(t *testing.T) {
+	config := NewConfig("app")
+	config.ReplaceRemoteConfig = true
+	if err := config.Validate(); err == nil {
+		t.Error("expected Replace_Remote_Config without files to be invalid")
+	}
+}
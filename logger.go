@@ -0,0 +1,72 @@
+package moesifmiddleware
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Logger receives the middleware's log output. Messages are constant strings
+// and details are passed as alternating key, value pairs, for example
+// "transaction_id", id. A *slog.Logger satisfies Logger, see NewSlogLogger.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// stdLogger writes to the standard log package as "LEVEL msg key=value ...".
+// Debug messages are only written when debug is set.
+type stdLogger struct {
+	debug bool
+}
+
+// defaultLogger is used where no client, and so no Logger option, is available
+var defaultLogger Logger = stdLogger{}
+
+// newLogger returns the Logger option, or a stdLogger honoring the Debug option
+func newLogger(config *Config) Logger {
+	if config.Logger != nil {
+		return config.Logger
+	}
+	return stdLogger{debug: config.Debug}
+}
+
+func (l stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if l.debug {
+		l.output("DEBUG", msg, keysAndValues)
+	}
+}
+
+func (l stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.output("INFO", msg, keysAndValues)
+}
+
+func (l stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.output("WARN", msg, keysAndValues)
+}
+
+func (l stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.output("ERROR", msg, keysAndValues)
+}
+
+func (l stdLogger) output(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" moesif: ")
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "!MISSING"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&b, " %v=%s", keysAndValues[i], s)
+	}
+	log.Print(b.String())
+}
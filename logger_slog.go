@@ -0,0 +1,12 @@
+//go:build go1.21
+// +build go1.21
+
+package moesifmiddleware
+
+import "log/slog"
+
+// NewSlogLogger returns a Logger writing to h, so that the middleware's
+// output goes wherever the rest of the application's structured logs go
+func NewSlogLogger(h slog.Handler) Logger {
+	return slog.New(h)
+}
@@ -0,0 +1,52 @@
+//go:build go1.21
+// +build go1.21
+
+package moesifmiddleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStdLoggerFormat(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+
+	stdLogger{}.Debug("hidden")
+	stdLogger{debug: true}.Debug("Sending", "direction", "Incoming", "error", "read failed", "odd")
+	expected := `DEBUG moesif: Sending direction=Incoming error="read failed" odd=!MISSING` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	config := NewConfig("app")
+	config.Logger = NewSlogLogger(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c, _ := newTestClient(config)
+
+	serve(c.Middleware(echo), "GET", "/items", "")
+
+	var sending map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("not a JSON log line: %q", line)
+		}
+		if record["msg"] == "Sending the event to Moesif" {
+			sending = record
+		}
+	}
+	if sending == nil || sending["level"] != "DEBUG" || sending["direction"] != "Incoming" || sending["transaction_id"] == "" {
+		t.Errorf("expected a structured debug record, got %s", buf.String())
+	}
+}
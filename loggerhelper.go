@@ -3,9 +3,11 @@ package moesifmiddleware
 import (
 	b64 "encoding/base64"
 	"encoding/json"
-	"log"
+	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func contains(arr []string, str string) bool {
@@ -17,18 +19,18 @@ func contains(arr []string, str string) bool {
 	return false
 }
 
-func getConfigStringValuesForIncomingEvent(fieldName string, request *http.Request, response MoesifResponseRecorder) string {
+func getConfigStringValuesForIncomingEvent(getValue func(*http.Request, MoesifResponseRecorder) string, request *http.Request, response MoesifResponseRecorder) string {
 	var field string
-	if _, found := moesifOption[fieldName]; found {
-		field = moesifOption[fieldName].(func(*http.Request, MoesifResponseRecorder) string)(request, response)
+	if getValue != nil {
+		field = getValue(request, response)
 	}
 	return field
 }
 
-func getConfigStringValuesForOutgoingEvent(fieldName string, request *http.Request, response *http.Response) string {
+func getConfigStringValuesForOutgoingEvent(getValue func(*http.Request, *http.Response) string, request *http.Request, response *http.Response) string {
 	var field string
-	if _, found := moesifOption[fieldName]; found {
-		field = moesifOption[fieldName].(func(*http.Request, *http.Response) string)(request, response)
+	if getValue != nil {
+		field = getValue(request, response)
 	}
 	return field
 }
@@ -41,77 +43,149 @@ func HeaderToMap(header http.Header) map[string]interface{} {
 	return headerMap
 }
 
-func maskHeaders(headers map[string]interface{}, fieldName string) map[string]interface{} {
-	var maskFields []string
-	if _, found := moesifOption[fieldName]; found {
-		maskFields = moesifOption[fieldName].(func() []string)()
-		headers = maskData(headers, maskFields)
+// DefaultHeaderMasks are masked in requests and responses unless they are
+// listed in the Unmasked_Headers option
+var DefaultHeaderMasks = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"}
+
+// containsFold is contains ignoring case
+func containsFold(arr []string, str string) bool {
+	for _, value := range arr {
+		if strings.EqualFold(value, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskHeaders masks the headers named in masks or DefaultHeaderMasks, ignoring
+// case, with the Mask_Strategies strategy for their name. If the Cookie_Masks
+// option is set, Cookie and Set-Cookie headers not named in masks have only
+// the cookies it names masked.
+func (c *Client) maskHeaders(headers map[string]interface{}, masks func() []string) map[string]interface{} {
+	var names, cookieMasks []string
+	if masks != nil {
+		names = masks()
+	}
+	if c.config.CookieMasks != nil {
+		cookieMasks = c.config.CookieMasks()
+	}
+	for key, val := range headers {
+		if values, ok := val.([]string); ok && c.config.CookieMasks != nil && isCookieHeader(key) && !containsFold(names, key) {
+			if masked := c.maskCookies(key, values, cookieMasks); len(masked) > 0 {
+				headers[key] = masked
+			} else {
+				delete(headers, key)
+			}
+			continue
+		}
+		if !containsFold(names, key) && (!containsFold(DefaultHeaderMasks, key) || containsFold(c.config.UnmaskedHeaders, key)) {
+			continue
+		}
+		mask := key
+		for name := range c.config.MaskStrategies {
+			if strings.EqualFold(name, key) {
+				mask = name
+			}
+		}
+		if masked, keep := applyMask(c.config.MaskStrategies, mask, val); keep {
+			headers[key] = masked
+		} else {
+			delete(headers, key)
+		}
 	}
 	return headers
 }
 
-func maskData(data map[string]interface{}, maskBody []string) map[string]interface{} {
+// maskData masks the values of the fields of data named in maskBody with their
+// Mask_Strategies, descending into nested maps and arrays at any depth
+func maskData(data map[string]interface{}, maskBody []string, strategies map[string]MaskStrategy) map[string]interface{} {
 	for key, val := range data {
-		switch val.(type) {
-		case map[string]interface{}:
-			if contains(maskBody, key) {
-				data[key] = "*****"
+		if contains(maskBody, key) {
+			if masked, keep := applyMask(strategies, key, val); keep {
+				data[key] = masked
 			} else {
-				maskData(val.(map[string]interface{}), maskBody)
-			}
-		default:
-			if contains(maskBody, key) {
-				data[key] = "*****"
+				delete(data, key)
 			}
+		} else {
+			maskValue(val, maskBody, strategies)
 		}
 	}
 	return data
 }
 
-func parseBody(readReqBody []byte, fieldName string) (interface{}, string) {
+// maskValue masks the maps in val with maskData, descending into arrays
+func maskValue(val interface{}, maskBody []string, strategies map[string]MaskStrategy) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return maskData(v, maskBody, strategies)
+	case []interface{}:
+		for i, element := range v {
+			v[i] = maskValue(element, maskBody, strategies)
+		}
+		return v
+	}
+	return val
+}
+
+// parseBody parses body as JSON, with a Body_Parsers parser for contentType, or
+// with a default parser for contentType, before masking it. Bodies that cannot
+// be parsed are logged as base64.
+func (c *Client) parseBody(readReqBody []byte, contentType string, masks func() []string) (interface{}, string) {
 	var body interface{}
 	bodyEncoding := "json"
-	if jsonMarshalErr := json.Unmarshal(readReqBody, &body); jsonMarshalErr != nil {
-		if debug {
-			log.Printf("About to parse body as base64 ")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var parseErr error
+	if parser := lookupBodyParser(c.config.BodyParsers, mediaType); parser != nil {
+		body, parseErr = parser(readReqBody, contentType)
+	} else if parseErr = json.Unmarshal(readReqBody, &body); parseErr != nil {
+		if parser := lookupBodyParser(defaultBodyParsers, mediaType); parser != nil {
+			body, parseErr = parser(readReqBody, contentType)
 		}
+	}
+	if parseErr != nil {
 		body = b64.StdEncoding.EncodeToString(readReqBody)
 		bodyEncoding = "base64"
-		if debug {
-			log.Printf("Parsed body as base64 - %s", body)
-		}
+		c.logger.Debug("Parsed body as base64", "length", len(readReqBody), "content_type", contentType)
 	} else {
 		// Mask Json data
-		var maskFields []string
-		if _, found := moesifOption[fieldName]; found {
-			maskFields = moesifOption[fieldName].(func() []string)()
-			if mappedBody, ok := body.(map[string]interface{}); ok {
-				body = maskData(mappedBody, maskFields)
-			} else {
-				log.Printf("Expected body to be a map but got: %T", body)
-			}
+		if masks != nil {
+			body = c.maskBody(body, masks())
 		}
 	}
 	return body, bodyEncoding
 }
 
+// maskBody masks the maps and arrays in body, or each record of a body made
+// of JSON records
+func (c *Client) maskBody(body interface{}, masks []string) interface{} {
+	switch b := body.(type) {
+	case map[string]interface{}, []interface{}:
+		return c.maskFields(body, masks)
+	case records:
+		for i, record := range b {
+			b[i] = c.maskFields(record, masks)
+		}
+		return b
+	default:
+		c.logger.Debug("Body is not a map or an array, skipping masks", "type", fmt.Sprintf("%T", body))
+		return body
+	}
+}
+
 // getContentLength tries to parse the Content-Length header to an int64.
-// If parsing fails or the header is not present, it uses the length of the provided body slice.
+// If parsing fails or the header is not present, it uses the size of the body.
 // Returns a pointer to the determined content length.
-func getContentLength(headers http.Header, body []byte) (contentLength *int64) {
+func (c *Client) getContentLength(headers http.Header, size int64) (contentLength *int64) {
 	if contentLengthStr := headers.Get("Content-Length"); contentLengthStr != "" {
 		parsedLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
 		if err != nil {
-			if debug {
-				log.Printf("Error while parsing content-length: %s.\n", err)
-			}
+			c.logger.Debug("Error while parsing content-length", "error", err)
 		} else {
 			contentLength = &parsedLength
 		}
 	}
 	if contentLength == nil {
-		length := int64(len(body))
-		contentLength = &length
+		contentLength = &size
 	}
 	return contentLength
 }
@@ -0,0 +1,93 @@
+package moesifmiddleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMaskBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		masks    []string
+		expected string
+	}{
+		{"top level field", `{"password":"a","name":"b"}`, []string{"password"},
+			`{"password":"*****","name":"b"}`},
+		{"nested map", `{"user":{"password":"a"}}`, []string{"password"},
+			`{"user":{"password":"*****"}}`},
+		{"masked map", `{"user":{"password":"a"}}`, []string{"user"},
+			`{"user":"*****"}`},
+		{"array of objects", `{"users":[{"password":"a"},{"password":"b","name":"c"}]}`, []string{"password"},
+			`{"users":[{"password":"*****"},{"password":"*****","name":"c"}]}`},
+		{"masked array", `{"cards":[{"number":"1"}]}`, []string{"cards"},
+			`{"cards":"*****"}`},
+		{"nested arrays", `{"matrix":[[{"ssn":"1"}],[[{"ssn":"2"}]]]}`, []string{"ssn"},
+			`{"matrix":[[{"ssn":"*****"}],[[{"ssn":"*****"}]]]}`},
+		{"top level array", `[{"password":"a"},{"items":[{"password":"b"}]}]`, []string{"password"},
+			`[{"password":"*****"},{"items":[{"password":"*****"}]}]`},
+		{"top level array of scalars", `[1,"password",null]`, []string{"password"},
+			`[1,"password",null]`},
+		{"scalar", `"password"`, []string{"password"},
+			`"password"`},
+		{"no masks", `[{"password":"a"}]`, nil,
+			`[{"password":"a"}]`},
+	}
+	c, _ := newTestClient(NewConfig("app"))
+	for _, test := range tests {
+		var body, expected interface{}
+		json.Unmarshal([]byte(test.body), &body)
+		json.Unmarshal([]byte(test.expected), &expected)
+		if masked := c.maskBody(body, test.masks); !reflect.DeepEqual(masked, expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, masked, expected)
+		}
+	}
+}
+
+func TestParseBodyMasksArrays(t *testing.T) {
+	c, _ := newTestClient(NewConfig("app"))
+	body, encoding := c.parseBody([]byte(`[{"password":"a"}]`), "application/json", func() []string { return []string{"password"} })
+	expected := []interface{}{map[string]interface{}{"password": "*****"}}
+	if !reflect.DeepEqual(body, expected) || encoding != "json" {
+		t.Errorf("got %v as %s, expected %v", body, encoding, expected)
+	}
+}
+
+func TestMaskHeaders(t *testing.T) {
+	header := http.Header{
+		"Authorization":       {"Bearer a"},
+		"Cookie":              {"session=a"},
+		"Proxy-Authorization": {"Basic a"},
+		"X-Api-Key":           {"a"},
+		"X-User-Token":        {"a"},
+		"Content-Type":        {"application/json"},
+	}
+	tests := []struct {
+		name     string
+		masks    func() []string
+		unmasked []string
+		expected []string
+	}{
+		{"defaults", nil, nil,
+			[]string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"}},
+		{"masks ignore case", func() []string { return []string{"x-user-token", "CONTENT-TYPE"} }, nil,
+			[]string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key", "X-User-Token", "Content-Type"}},
+		{"opt out of defaults", nil, []string{"cookie", "X-Api-Key"},
+			[]string{"Authorization", "Proxy-Authorization"}},
+		{"masks take precedence over opt outs", func() []string { return []string{"Cookie"} }, []string{"Cookie"},
+			[]string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"}},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.UnmaskedHeaders = test.unmasked
+		c, _ := newTestClient(config)
+		masked := c.maskHeaders(HeaderToMap(header), test.masks)
+		for name := range header {
+			if isMasked := masked[name] == "*****"; isMasked != contains(test.expected, name) {
+				t.Errorf("%s: %s masked=%v", test.name, name, isMasked)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package moesifmiddleware
+
+import "strings"
+
+// isCookieHeader reports whether name is the Cookie or Set-Cookie header
+func isCookieHeader(name string) bool {
+	return strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie")
+}
+
+// maskCookies masks the cookies named in the Cookie_Masks option in the values
+// of a Cookie or Set-Cookie header, with the Mask_Strategies strategy for their
+// name. Other cookies and Set-Cookie attributes are kept as they are.
+func (c *Client) maskCookies(name string, values []string, masks []string) []string {
+	setCookie := strings.EqualFold(name, "Set-Cookie")
+	masked := make([]string, 0, len(values))
+	for _, value := range values {
+		pairs := strings.Split(value, ";")
+		kept := pairs[:0]
+		for i, pair := range pairs {
+			if setCookie && i > 0 {
+				kept = append(kept, pair)
+				continue
+			}
+			pair, keep := c.maskCookie(pair, masks)
+			if keep {
+				kept = append(kept, pair)
+			} else if setCookie {
+				break
+			}
+		}
+		if len(kept) > 0 {
+			masked = append(masked, strings.TrimSpace(strings.Join(kept, ";")))
+		}
+	}
+	return masked
+}
+
+// maskCookie masks one name=value pair, returning false if it is removed
+func (c *Client) maskCookie(pair string, masks []string) (string, bool) {
+	eq := strings.IndexByte(pair, '=')
+	if eq < 0 {
+		return pair, true
+	}
+	name := strings.TrimSpace(pair[:eq])
+	if !contains(masks, name) {
+		return pair, true
+	}
+	masked, keep := applyMask(c.config.MaskStrategies, name, strings.TrimSpace(pair[eq+1:]))
+	if !keep {
+		return "", false
+	}
+	return pair[:eq+1] + maskString(masked), true
+}
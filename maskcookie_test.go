@@ -0,0 +1,68 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMaskCookies(t *testing.T) {
+	header := http.Header{
+		"Cookie": {"session_id=abc; theme=dark; csrf_token=def"},
+		"Set-Cookie": {
+			"session_id=abc; Path=/; HttpOnly",
+			"theme=dark; Max-Age=3600",
+			"csrf_token=def; Secure",
+		},
+	}
+	tests := []struct {
+		name       string
+		masks      func() []string
+		strategies map[string]MaskStrategy
+		expected   map[string]interface{}
+	}{
+		{"named cookies", nil, nil, map[string]interface{}{
+			"Cookie": []string{"session_id=*****; theme=dark; csrf_token=*****"},
+			"Set-Cookie": []string{
+				"session_id=*****; Path=/; HttpOnly",
+				"theme=dark; Max-Age=3600",
+				"csrf_token=*****; Secure",
+			},
+		}},
+		{"strategies", nil, map[string]MaskStrategy{"session_id": KeepLastMask(1), "csrf_token": RemoveMask}, map[string]interface{}{
+			"Cookie": []string{"session_id=**c; theme=dark"},
+			"Set-Cookie": []string{
+				"session_id=**c; Path=/; HttpOnly",
+				"theme=dark; Max-Age=3600",
+			},
+		}},
+		{"header masks take precedence", func() []string { return []string{"cookie"} }, nil, map[string]interface{}{
+			"Cookie": "*****",
+			"Set-Cookie": []string{
+				"session_id=*****; Path=/; HttpOnly",
+				"theme=dark; Max-Age=3600",
+				"csrf_token=*****; Secure",
+			},
+		}},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.CookieMasks = func() []string { return []string{"session_id", "csrf_token"} }
+		config.MaskStrategies = test.strategies
+		c, _ := newTestClient(config)
+		if masked := c.maskHeaders(HeaderToMap(header), test.masks); !reflect.DeepEqual(masked, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, masked, test.expected)
+		}
+	}
+}
+
+func TestMaskCookiesFirstRemoved(t *testing.T) {
+	config := NewConfig("app")
+	config.CookieMasks = func() []string { return []string{"session_id"} }
+	config.MaskStrategies = map[string]MaskStrategy{"session_id": RemoveMask}
+	c, _ := newTestClient(config)
+	masked := c.maskHeaders(map[string]interface{}{"Cookie": []string{"session_id=abc; theme=dark", "session_id=def"}}, nil)
+	if expected := []string{"theme=dark"}; !reflect.DeepEqual(masked["Cookie"], expected) {
+		t.Errorf("got %v, expected %v", masked["Cookie"], expected)
+	}
+}
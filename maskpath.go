@@ -0,0 +1,135 @@
+package moesifmiddleware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maskStep is one step of a mask path: a field name, an array index, or a
+// wildcard matching every field or element
+type maskStep struct {
+	name     string
+	index    int // -1 for a field name or wildcard
+	wildcard bool
+}
+
+// isMaskPath reports whether mask is a path expression rather than a bare
+// field name. Bare names match the field anywhere in a body.
+func isMaskPath(mask string) bool {
+	return strings.HasPrefix(mask, "$") || strings.ContainsAny(mask, ".[")
+}
+
+// parseMaskPath parses a path expression from the root of a body, such as
+// "user.ssn", "$.cards[*].number", "items[0].id" or "['a.b'].c"
+func parseMaskPath(path string) ([]maskStep, error) {
+	var steps []maskStep
+	s := strings.TrimPrefix(path, "$")
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("mask path %q: missing ]", path)
+			}
+			step, err := parseBracketStep(s[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("mask path %q: %v", path, err)
+			}
+			steps = append(steps, step)
+			i += end + 1
+		case s[i] == '.' || i == 0 && len(s) == len(path):
+			// a name follows a dot, or starts a path without a leading $
+			if s[i] == '.' {
+				i++
+			}
+			end := strings.IndexAny(s[i:], ".[")
+			if end < 0 {
+				end = len(s) - i
+			}
+			name := s[i : i+end]
+			if name == "" {
+				return nil, fmt.Errorf("mask path %q: empty field name", path)
+			}
+			steps = append(steps, maskStep{name: name, index: -1, wildcard: name == "*"})
+			i += end
+		default:
+			return nil, fmt.Errorf("mask path %q: unexpected %q", path, s[i])
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("mask path %q: no fields", path)
+	}
+	return steps, nil
+}
+
+// parseBracketStep parses the inside of [*], [0], ['name'] or ["name"]
+func parseBracketStep(s string) (maskStep, error) {
+	if s == "*" {
+		return maskStep{index: -1, wildcard: true}, nil
+	}
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return maskStep{name: s[1 : len(s)-1], index: -1}, nil
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		return maskStep{}, fmt.Errorf("invalid index %q", s)
+	}
+	return maskStep{index: index}, nil
+}
+
+// maskPath masks the values in val matched by steps with the Mask_Strategies
+// strategy for mask, returning the new value of val
+func maskPath(val interface{}, steps []maskStep, mask string, strategies map[string]MaskStrategy) interface{} {
+	step, rest := steps[0], steps[1:]
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if !step.wildcard && (step.index >= 0 || key != step.name) {
+				continue
+			}
+			if len(rest) > 0 {
+				v[key] = maskPath(child, rest, mask, strategies)
+			} else if masked, keep := applyMask(strategies, mask, child); keep {
+				v[key] = masked
+			} else {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		kept := v[:0]
+		for i, child := range v {
+			if step.wildcard || i == step.index {
+				if len(rest) > 0 {
+					child = maskPath(child, rest, mask, strategies)
+				} else if masked, keep := applyMask(strategies, mask, child); keep {
+					child = masked
+				} else {
+					continue
+				}
+			}
+			kept = append(kept, child)
+		}
+		return kept
+	}
+	return val
+}
+
+// maskFields masks body with masks, which are bare field names matched
+// anywhere in body or path expressions from its root, using their Mask_Strategies
+func (c *Client) maskFields(body interface{}, masks []string) interface{} {
+	var names []string
+	for _, mask := range masks {
+		if !isMaskPath(mask) {
+			names = append(names, mask)
+		} else if steps, err := parseMaskPath(mask); err == nil {
+			body = maskPath(body, steps, mask, c.config.MaskStrategies)
+		} else {
+			c.logger.Warn("Ignoring invalid mask", "mask", mask, "error", err)
+		}
+	}
+	if len(names) > 0 {
+		body = maskValue(body, names, c.config.MaskStrategies)
+	}
+	return body
+}
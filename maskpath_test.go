@@ -0,0 +1,75 @@
+package moesifmiddleware
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseMaskPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []maskStep
+	}{
+		{"user.ssn", []maskStep{{name: "user", index: -1}, {name: "ssn", index: -1}}},
+		{"$.user.ssn", []maskStep{{name: "user", index: -1}, {name: "ssn", index: -1}}},
+		{"cards[*].number", []maskStep{{name: "cards", index: -1}, {index: -1, wildcard: true}, {name: "number", index: -1}}},
+		{"items[0].id", []maskStep{{name: "items", index: -1}, {index: 0}, {name: "id", index: -1}}},
+		{"$[1]", []maskStep{{index: 1}}},
+		{"[*].password", []maskStep{{index: -1, wildcard: true}, {name: "password", index: -1}}},
+		{"*.token", []maskStep{{name: "*", index: -1, wildcard: true}, {name: "token", index: -1}}},
+		{"['a.b'][\"c\"]", []maskStep{{name: "a.b", index: -1}, {name: "c", index: -1}}},
+		{"matrix[0][2]", []maskStep{{name: "matrix", index: -1}, {index: 0}, {index: 2}}},
+	}
+	for _, test := range tests {
+		steps, err := parseMaskPath(test.path)
+		if err != nil || !reflect.DeepEqual(steps, test.expected) {
+			t.Errorf("%s: got %+v %v, expected %+v", test.path, steps, err, test.expected)
+		}
+	}
+
+	for _, path := range []string{"$", "a..b", "a.", "a[", "a[x]", "a[-1]", "$a", "a[0]b"} {
+		if steps, err := parseMaskPath(path); err == nil {
+			t.Errorf("%s: expected an error, got %+v", path, steps)
+		}
+	}
+}
+
+func TestMaskFieldsWithPaths(t *testing.T) {
+	const body = `{"id":1,"user":{"id":2,"ssn":"1"},"cards":[{"id":3,"number":"4111"},{"number":"5500"}],"items":[{"id":4},{"id":5}]}`
+	tests := []struct {
+		name     string
+		body     string
+		masks    []string
+		expected string
+	}{
+		{"dot path", body, []string{"user.ssn"},
+			`{"id":1,"user":{"id":2,"ssn":"*****"},"cards":[{"id":3,"number":"4111"},{"number":"5500"}],"items":[{"id":4},{"id":5}]}`},
+		{"path only matches from the root", body, []string{"user.id"},
+			`{"id":1,"user":{"id":"*****","ssn":"1"},"cards":[{"id":3,"number":"4111"},{"number":"5500"}],"items":[{"id":4},{"id":5}]}`},
+		{"array wildcard", body, []string{"cards[*].number"},
+			`{"id":1,"user":{"id":2,"ssn":"1"},"cards":[{"id":3,"number":"*****"},{"number":"*****"}],"items":[{"id":4},{"id":5}]}`},
+		{"array index", body, []string{"$.items[1].id"},
+			`{"id":1,"user":{"id":2,"ssn":"1"},"cards":[{"id":3,"number":"4111"},{"number":"5500"}],"items":[{"id":4},{"id":"*****"}]}`},
+		{"field wildcard", body, []string{"*.ssn", "*[*].id"},
+			`{"id":1,"user":{"id":2,"ssn":"*****"},"cards":[{"id":"*****","number":"4111"},{"number":"5500"}],"items":[{"id":"*****"},{"id":"*****"}]}`},
+		{"bare name matches anywhere", body, []string{"id"},
+			`{"id":"*****","user":{"id":"*****","ssn":"1"},"cards":[{"id":"*****","number":"4111"},{"number":"5500"}],"items":[{"id":"*****"},{"id":"*****"}]}`},
+		{"whole subtree", body, []string{"cards"},
+			`{"id":1,"user":{"id":2,"ssn":"1"},"cards":"*****","items":[{"id":4},{"id":5}]}`},
+		{"missing path", body, []string{"user.name", "items[5].id", "id.value"}, body},
+		{"top level array", `[{"password":"a"},{"password":"b"}]`, []string{"[0].password"},
+			`[{"password":"*****"},{"password":"b"}]`},
+		{"quoted name", `{"a.b":{"c":1}}`, []string{"['a.b'].c"}, `{"a.b":{"c":"*****"}}`},
+		{"invalid path ignored", body, []string{"cards[x]"}, body},
+	}
+	c, _ := newTestClient(NewConfig("app"))
+	for _, test := range tests {
+		var parsed, expected interface{}
+		json.Unmarshal([]byte(test.body), &parsed)
+		json.Unmarshal([]byte(test.expected), &expected)
+		if masked := c.maskBody(parsed, test.masks); !reflect.DeepEqual(masked, expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, masked, expected)
+		}
+	}
+}
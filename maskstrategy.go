@@ -0,0 +1,95 @@
+package moesifmiddleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// MaskStrategy returns the value logged in place of a masked value, or false
+// to remove the field from the event. Header values are masked one at a time.
+type MaskStrategy func(value interface{}) (masked interface{}, keep bool)
+
+// HashMask replaces values with the hex SHA-256 hash of salt followed by the
+// value, so that masked values can still be correlated. Values that are not
+// strings are hashed as JSON.
+func HashMask(salt string) MaskStrategy {
+	return func(value interface{}) (interface{}, bool) {
+		sum := sha256.Sum256([]byte(salt + maskString(value)))
+		return hex.EncodeToString(sum[:]), true
+	}
+}
+
+// KeepLastMask replaces all but the last n characters of values with "*".
+// Values of n characters or less are replaced entirely, and values that are
+// not strings are masked as JSON. A negative n is treated as 0.
+func KeepLastMask(n int) MaskStrategy {
+	if n < 0 {
+		n = 0
+	}
+	return func(value interface{}) (interface{}, bool) {
+		s := []rune(maskString(value))
+		if len(s) <= n {
+			return strings.Repeat("*", len(s)), true
+		}
+		return strings.Repeat("*", len(s)-n) + string(s[len(s)-n:]), true
+	}
+}
+
+// RemoveMask removes masked fields from the event
+var RemoveMask MaskStrategy = func(interface{}) (interface{}, bool) {
+	return nil, false
+}
+
+// PlaceholderMask replaces values with a placeholder of the same JSON type:
+// "*****" for strings, 0 for numbers, false for booleans, and an empty array or
+// object. null is kept.
+var PlaceholderMask MaskStrategy = func(value interface{}) (interface{}, bool) {
+	switch value.(type) {
+	case nil:
+		return nil, true
+	case bool:
+		return false, true
+	case float64, float32, int, int64, int32, json.Number:
+		return 0, true
+	case []interface{}:
+		return []interface{}{}, true
+	case map[string]interface{}:
+		return map[string]interface{}{}, true
+	default:
+		return "*****", true
+	}
+}
+
+// maskString returns value as a string, or as JSON if it is not a string
+func maskString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// applyMask masks value with the Mask_Strategies strategy for mask, or with
+// "*****" if mask has none. Each value of a header is masked separately, and
+// the header is removed if the strategy removes any of them.
+func applyMask(strategies map[string]MaskStrategy, mask string, value interface{}) (interface{}, bool) {
+	strategy := strategies[mask]
+	if strategy == nil {
+		return "*****", true
+	}
+	values, ok := value.([]string)
+	if !ok {
+		return strategy(value)
+	}
+	masked := make([]interface{}, len(values))
+	for i, v := range values {
+		m, keep := strategy(v)
+		if !keep {
+			return nil, false
+		}
+		masked[i] = m
+	}
+	return masked, true
+}
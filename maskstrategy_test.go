@@ -0,0 +1,98 @@
+package moesifmiddleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMaskStrategies(t *testing.T) {
+	strategies := map[string]MaskStrategy{
+		"email":          HashMask("salt"),
+		"card":           KeepLastMask(4),
+		"pin":            KeepLastMask(4),
+		"cvv":            KeepLastMask(-1),
+		"ssn":            RemoveMask,
+		"profile":        PlaceholderMask,
+		"age":            PlaceholderMask,
+		"active":         PlaceholderMask,
+		"tags":           PlaceholderMask,
+		"items[*].price": PlaceholderMask,
+		"items[0]":       RemoveMask,
+	}
+	hashed, _ := HashMask("salt")("a@b.com")
+	tests := []struct {
+		name     string
+		body     string
+		masks    []string
+		expected string
+	}{
+		{"hash", `{"email":"a@b.com"}`, []string{"email"},
+			fmt.Sprintf(`{"email":%q}`, hashed)},
+		{"keep last", `{"card":"4111111111111111","pin":"123"}`, []string{"card", "pin"},
+			`{"card":"************1111","pin":"***"}`},
+		{"keep last of a number", `{"card":4111111111111111}`, []string{"card"},
+			`{"card":"************1111"}`},
+		{"keep last of negative length", `{"cvv":"123"}`, []string{"cvv"},
+			`{"cvv":"***"}`},
+		{"remove", `{"user":{"ssn":"1","name":"a"}}`, []string{"ssn"},
+			`{"user":{"name":"a"}}`},
+		{"placeholder", `{"profile":{"a":1},"age":30,"active":true,"tags":["a"],"email":null}`, []string{"profile", "age", "active", "tags"},
+			`{"profile":{},"age":0,"active":false,"tags":[],"email":null}`},
+		{"default", `{"password":"a"}`, []string{"password"},
+			`{"password":"*****"}`},
+		{"path", `{"items":[{"price":5,"name":"a"},{"price":6}]}`, []string{"items[*].price"},
+			`{"items":[{"price":0,"name":"a"},{"price":0}]}`},
+		{"remove array element", `{"items":[1,2,3]}`, []string{"items[0]"},
+			`{"items":[2,3]}`},
+	}
+	config := NewConfig("app")
+	config.MaskStrategies = strategies
+	c, _ := newTestClient(config)
+	for _, test := range tests {
+		var body, expected interface{}
+		json.Unmarshal([]byte(test.body), &body)
+		json.Unmarshal([]byte(test.expected), &expected)
+		// compare as JSON, since placeholders are ints rather than float64s
+		m, _ := json.Marshal(c.maskBody(body, test.masks))
+		e, _ := json.Marshal(expected)
+		if string(m) != string(e) {
+			t.Errorf("%s: got %s, expected %s", test.name, m, e)
+		}
+	}
+}
+
+func TestHashMask(t *testing.T) {
+	a, _ := HashMask("salt")("a@b.com")
+	b, _ := HashMask("salt")("a@b.com")
+	c, _ := HashMask("pepper")("a@b.com")
+	if a != b || a == c || len(a.(string)) != 64 {
+		t.Errorf("expected a stable salted hash, got %v, %v and %v", a, b, c)
+	}
+}
+
+func TestHeaderMaskStrategies(t *testing.T) {
+	headers := HeaderToMap(http.Header{
+		"Authorization": {"Bearer abcdef123456"},
+		"X-Session":     {"1", "2"},
+		"X-Api-Key":     {"key"},
+		"X-Other":       {"a"},
+	})
+	config := NewConfig("app")
+	config.MaskStrategies = map[string]MaskStrategy{
+		"authorization": KeepLastMask(4),
+		"X-Session":     RemoveMask,
+	}
+	c, _ := newTestClient(config)
+	masked := c.maskHeaders(headers, func() []string { return []string{"x-session"} })
+	expected := map[string]interface{}{
+		"Authorization": []interface{}{"***************3456"},
+		"X-Api-Key":     "*****",
+		"X-Other":       []string{"a"},
+	}
+	if !reflect.DeepEqual(masked, expected) {
+		t.Errorf("got %v, expected %v", masked, expected)
+	}
+}
@@ -0,0 +1,60 @@
+package moesifmiddleware
+
+import (
+	"net/url"
+	"strings"
+)
+
+// maskQuery masks the values of the query parameters named in the
+// Query_Param_Masks option, ignoring case, with the Mask_Strategies strategy
+// for their name. The order of the parameters is kept.
+func (c *Client) maskQuery(rawQuery string) string {
+	if c.config.QueryParamMasks == nil || rawQuery == "" {
+		return rawQuery
+	}
+	masks := c.config.QueryParamMasks()
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, value := param, ""
+		if eq := strings.IndexByte(param, '='); eq >= 0 {
+			key, value = param[:eq], param[eq+1:]
+		}
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		for _, mask := range masks {
+			if !strings.EqualFold(mask, name) {
+				continue
+			}
+			if unescaped, err := url.QueryUnescape(value); err == nil {
+				value = unescaped
+			}
+			masked, keep := applyMask(c.config.MaskStrategies, mask, value)
+			if keep {
+				param = key + "=" + strings.ReplaceAll(url.QueryEscape(maskString(masked)), "%2A", "*")
+			} else {
+				param = ""
+			}
+			break
+		}
+		if param != "" {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// maskPath passes the segments of path to the Mask_Path_Segments hook
+func (c *Client) maskPath(path string) string {
+	if c.config.MaskPathSegments == nil || path == "" {
+		return path
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	masked := strings.Join(c.config.MaskPathSegments(segments), "/")
+	if strings.HasPrefix(path, "/") {
+		masked = "/" + masked
+	}
+	return masked
+}
@@ -0,0 +1,94 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaskQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		strategies map[string]MaskStrategy
+		expected   string
+	}{
+		{"masks ignore case", "API_KEY=a&page=2&token=b", nil,
+			"API_KEY=*****&page=2&token=*****"},
+		{"repeated and encoded names", "token=a&t%6Fken=b&token", nil,
+			"token=*****&t%6Fken=*****&token=*****"},
+		{"strategy", "api_key=abc%2F1234", map[string]MaskStrategy{"api_key": KeepLastMask(4)},
+			"api_key=****1234"},
+		{"remove", "page=1&token=a&sort=b", map[string]MaskStrategy{"token": RemoveMask},
+			"page=1&sort=b"},
+		{"no masked params", "page=1&sort=b", nil,
+			"page=1&sort=b"},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.QueryParamMasks = func() []string { return []string{"api_key", "token"} }
+		config.MaskStrategies = test.strategies
+		c, _ := newTestClient(config)
+		if masked := c.maskQuery(test.query); masked != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, masked, test.expected)
+		}
+	}
+}
+
+func TestMaskPath(t *testing.T) {
+	config := NewConfig("app")
+	config.MaskPathSegments = func(segments []string) []string {
+		for i := 1; i < len(segments); i++ {
+			if segments[i-1] == "users" {
+				segments[i] = ":id"
+			}
+		}
+		return segments
+	}
+	c, _ := newTestClient(config)
+	for path, expected := range map[string]string{
+		"/users/42/orders": "/users/:id/orders",
+		"/users/":          "/users/:id",
+		"users/42":         "users/:id",
+		"/":                "/",
+		"":                 "",
+	} {
+		if masked := c.maskPath(path); masked != expected {
+			t.Errorf("%q: got %q, expected %q", path, masked, expected)
+		}
+	}
+}
+
+func TestURIMasks(t *testing.T) {
+	config := NewConfig("app")
+	config.QueryParamMasks = func() []string { return []string{"token"} }
+	config.MaskPathSegments = func(segments []string) []string {
+		segments[len(segments)-1] = "*****"
+		return segments
+	}
+	c, api := newTestClient(config)
+
+	serve(c.Middleware(echo), "GET", "http://example.com/users/42?token=a&page=1", "")
+	events := waitForEvents(api, 1)
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	if uri := events[0].Request.Uri; uri != "http://example.com/users/*****?token=*****&page=1" {
+		t.Errorf("incoming event has uri %q", uri)
+	}
+
+	server := httptest.NewServer(echo)
+	defer server.Close()
+	response, err := (&http.Client{Transport: c.Transport(nil)}).Get(server.URL + "/users/42?token=a&page=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	events = api.Events()
+	if len(events) != 2 {
+		t.Fatalf("expected two events, got %d", len(events))
+	}
+	if uri := events[1].Request.Uri; uri != server.URL+"/users/*****?token=*****&page=1" {
+		t.Errorf("outgoing event has uri %q", uri)
+	}
+}
@@ -4,97 +4,44 @@
 package moesifmiddleware
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/rand"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"time"
 
-	moesifapi "github.com/moesif/moesifapi-go"
 	"github.com/moesif/moesifapi-go/models"
 )
 
-// Global variable
-var (
-	apiClient            moesifapi.API
-	debug                bool
-	moesifOption         map[string]interface{}
-	disableTransactionId bool
-	logBody              bool
-	logBodyOutgoing      bool
-	appConfig            = NewAppConfig()
-	governanceRules      = NewGovernanceRules()
-)
-
-// Initialize the client
-func moesifClient(moesifOption map[string]interface{}) {
-
-	var apiEndpoint string
-	var batchSize int
-	var eventQueueSize int
-	var timerWakeupSeconds int
-
-	// Try to fetch the api endpoint
-	if endpoint, found := moesifOption["Api_Endpoint"].(string); found {
-		apiEndpoint = endpoint
-	}
-
-	// Try to fetch the event queue size
-	if queueSize, found := moesifOption["Event_Queue_Size"].(int); found {
-		eventQueueSize = queueSize
-	}
-
-	// Try to fetch the batch size
-	if batch, found := moesifOption["Batch_Size"].(int); found {
-		batchSize = batch
-	}
-
-	// Try to fetch the timer wake up seconds
-	if timer, found := moesifOption["Timer_Wake_Up_Seconds"].(int); found {
-		timerWakeupSeconds = timer
-	}
-
-	api := moesifapi.NewAPI(moesifOption["Application_Id"].(string), &apiEndpoint, eventQueueSize, batchSize, timerWakeupSeconds)
-	api.SetEventsHeaderCallback("X-Moesif-Config-ETag", appConfig.Notify)
-	api.SetEventsHeaderCallback("X-Moesif-Rules-Tag", governanceRules.Notify)
-	apiClient = api
-
-	//  Disable debug by default
-	debug = false
-	// Try to fetch the debug from the option
-	if isDebug, found := moesifOption["Debug"].(bool); found {
-		debug = isDebug
-	}
-
-	// Disable TransactionId by default
-	disableTransactionId = false
-	// Try to fetch the disableTransactionId from the option
-	if isEnabled, found := moesifOption["disableTransactionId"].(bool); found {
-		disableTransactionId = isEnabled
+// configFromOptions converts the options map, logging rather than failing on
+// problems so that existing callers keep working
+func configFromOptions(configurationOption map[string]interface{}) func() *Config {
+	return func() *Config {
+		config, err := ConfigFromMap(configurationOption)
+		if err != nil {
+			newLogger(config).Error("Invalid configuration options", "error", err)
+		}
+		return config
 	}
+}
 
-	// Enable logBody by default
-	logBody = true
-	// Try to fetch the disableTransactionId from the option
-	if isEnabled, found := moesifOption["Log_Body"].(bool); found {
-		logBody = isEnabled
+// configOf returns config for getDefaultClient
+func configOf(config *Config) func() *Config {
+	return func() *Config {
+		return config
 	}
-
-	// run goroutine to check end point for updates
-	appConfig.Go()
-	// run goroutine to check end point for updates
-	governanceRules.Go()
 }
 
 // Moesif Response Recorder
 type MoesifResponseRecorder struct {
-	rw     http.ResponseWriter
-	status int
-	writer io.Writer
-	header map[string][]string
+	rw       http.ResponseWriter
+	status   int
+	writer   io.Writer
+	header   map[string][]string
+	streamed bool // the handler flushed the response
+	hijacked bool // the handler took over the connection
 }
 
 // Function to generate UUID
@@ -111,10 +58,10 @@ func uuid() (string, error) {
 // Response Recorder
 func responseRecorder(rw http.ResponseWriter, status int, writer io.Writer) MoesifResponseRecorder {
 	rr := MoesifResponseRecorder{
-		rw,
-		status,
-		writer,
-		make(map[string][]string, 5),
+		rw:     rw,
+		status: status,
+		writer: writer,
+		header: make(map[string][]string, 5),
 	}
 	return rr
 }
@@ -135,161 +82,260 @@ func (rec *MoesifResponseRecorder) Header() http.Header {
 	return rec.rw.Header()
 }
 
-// Start Capture Outgoing Request
-func StartCaptureOutgoing(configurationOption map[string]interface{}) {
-
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		// Set the Capture_Outoing_Requests to true to capture outgoing request
-		configurationOption["Capture_Outoing_Requests"] = true
-		moesifOption = configurationOption
-		moesifClient(moesifOption)
+// Implementing http.Flusher, the response is recorded as streamed
+func (rec *MoesifResponseRecorder) Flush() {
+	rec.streamed = true
+	if f, ok := rec.rw.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	if debug {
-		log.Println("Start Capturing outgoing requests")
+// Implementing http.Hijacker, returning http.ErrNotSupported if the underlying
+// ResponseWriter does not support it. The response is recorded as hijacked.
+func (rec *MoesifResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
 	}
-	// Enable logBody by default
-	logBodyOutgoing = true
-	// Try to fetch the disableTransactionId from the option
-	if isEnabled, found := moesifOption["Log_Body_Outgoing"].(bool); found {
-		logBodyOutgoing = isEnabled
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		rec.hijacked = true
 	}
-
-	http.DefaultTransport = DefaultTransport
+	return conn, rw, err
 }
 
-// Update User
-func UpdateUser(user *models.UserModel, configurationOption map[string]interface{}) {
-
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
+// Implementing http.Pusher, returning http.ErrNotSupported if the underlying
+// ResponseWriter does not support it
+func (rec *MoesifResponseRecorder) Push(target string, opts *http.PushOptions) error {
+	if p, ok := rec.rw.(http.Pusher); ok {
+		return p.Push(target, opts)
 	}
+	return http.ErrNotSupported
+}
 
-	// Add event to the queue
-	errUpdateUser := apiClient.QueueUser(user)
-	// Log the message
-	if errUpdateUser != nil {
-		log.Fatalf("Error while updating user: %s.\n", errUpdateUser.Error())
-	} else {
-		log.Println("Update User successfully added to the queue")
+// Implementing io.ReaderFrom. When the body is not being captured, this uses the
+// underlying ResponseWriter's ReadFrom so that optimizations like sendfile apply.
+func (rec *MoesifResponseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rec.writer.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
 	}
+	return io.Copy(rec.writer, src)
 }
 
-// Update Users Batch
-func UpdateUsersBatch(users []*models.UserModel, configurationOption map[string]interface{}) {
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (rec *MoesifResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.rw
+}
 
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
-	}
+// wrappedWriter is the part of MoesifResponseRecorder and ResponseOverride
+// that does not depend on the underlying ResponseWriter
+type wrappedWriter interface {
+	http.ResponseWriter
+	io.ReaderFrom
+	Unwrap() http.ResponseWriter
+}
 
-	// Add event to the queue
-	errUpdateUserBatch := apiClient.QueueUsers(users)
-	// Log the message
-	if errUpdateUserBatch != nil {
-		log.Fatalf("Error while updating users in batch: %s.\n", errUpdateUserBatch.Error())
-	} else {
-		log.Println("Updated Users successfully added to the queue")
-	}
+// fullWriter is a wrappedWriter with every optional interface
+type fullWriter interface {
+	wrappedWriter
+	http.Flusher
+	http.Hijacker
+	http.Pusher
 }
 
-// Update Company
-func UpdateCompany(company *models.CompanyModel, configurationOption map[string]interface{}) {
+// withInterfacesOf returns w with only the http.Flusher, http.Hijacker and
+// http.Pusher methods that underlying has, so that handlers checking for them
+// find what the connection supports
+func withInterfacesOf(w fullWriter, underlying http.ResponseWriter) http.ResponseWriter {
+	_, flusher := underlying.(http.Flusher)
+	_, hijacker := underlying.(http.Hijacker)
+	_, pusher := underlying.(http.Pusher)
+	switch {
+	case flusher && hijacker && pusher:
+		return w
+	case flusher && hijacker:
+		return struct {
+			wrappedWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case flusher && pusher:
+		return struct {
+			wrappedWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	case hijacker && pusher:
+		return struct {
+			wrappedWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	case flusher:
+		return struct {
+			wrappedWriter
+			http.Flusher
+		}{w, w}
+	case hijacker:
+		return struct {
+			wrappedWriter
+			http.Hijacker
+		}{w, w}
+	case pusher:
+		return struct {
+			wrappedWriter
+			http.Pusher
+		}{w, w}
+	}
+	return struct{ wrappedWriter }{w}
+}
 
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
+// Start Capture Outgoing Request
+func StartCaptureOutgoing(configurationOption map[string]interface{}) {
+	// Set the Capture_Outoing_Requests to true to capture outgoing request
+	configurationOption["Capture_Outoing_Requests"] = true
+	if c, err := getDefaultClient(configFromOptions(configurationOption)); err == nil {
+		startCaptureOutgoing(c)
 	}
+}
 
-	// Add event to the queue
-	errUpdateCompany := apiClient.QueueCompany(company)
-	// Log the message
-	if errUpdateCompany != nil {
-		log.Fatalf("Error while updating company: %s.\n", errUpdateCompany.Error())
-	} else {
-		log.Println("Update Company successfully added to the queue")
+// StartCaptureOutgoingWithConfig is StartCaptureOutgoing for a typed Config.
+// It returns the Config.Validate error instead of capturing if config is invalid,
+// and an error if the default client conflicts with a running Client.
+func StartCaptureOutgoingWithConfig(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	config.CaptureOutgoingRequests = true
+	c, err := getDefaultClient(configOf(config))
+	if err != nil {
+		return err
 	}
+	startCaptureOutgoing(c)
+	return nil
 }
 
-// Update Companies Batch
-func UpdateCompaniesBatch(companies []*models.CompanyModel, configurationOption map[string]interface{}) {
+// startCaptureOutgoing installs DefaultTransport, which captures outgoing calls
+// with the default client
+func startCaptureOutgoing(c *Client) {
+	c.logger.Debug("Start capturing outgoing requests")
 
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
-	}
+	http.DefaultTransport = DefaultTransport
+}
 
-	// Add event to the queue
-	errUpdateCompaniesBatch := apiClient.QueueCompanies(companies)
-	// Log the message
-	if errUpdateCompaniesBatch != nil {
-		log.Fatalf("Error while updating companies in batch: %s.\n", errUpdateCompaniesBatch.Error())
-	} else {
-		log.Println("Updated companies successfully added to the queue")
+// Update User
+func UpdateUser(user *models.UserModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
 	}
+	return c.UpdateUser(user)
 }
 
-// Update Subscription
-func UpdateSubscription(subscription *models.SubscriptionModel, configurationOption map[string]interface{}) { 
+// Update Users Batch
+func UpdateUsersBatch(users []*models.UserModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
+	}
+	return c.UpdateUsersBatch(users)
+}
 
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
+// Update Company
+func UpdateCompany(company *models.CompanyModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
 	}
+	return c.UpdateCompany(company)
+}
 
-	// Add event to the queue
-	errUpdateSubscription := apiClient.QueueSubscription(subscription)
-	// Log the message
-	if errUpdateSubscription != nil {
-		log.Fatalf("Error while updating subscription: %s.\n", errUpdateSubscription.Error())
-	} else {
-		log.Println("Update Subscription successfully added to the queue")
+// Update Companies Batch
+func UpdateCompaniesBatch(companies []*models.CompanyModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
 	}
+	return c.UpdateCompaniesBatch(companies)
 }
 
-// Update Subscriptions Batch
-func UpdateSubscriptionsBatch(subscriptions []*models.SubscriptionModel, configurationOption map[string]interface{}) {
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifClient(configurationOption)
+// Update Subscription
+func UpdateSubscription(subscription *models.SubscriptionModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
 	}
+	return c.UpdateSubscription(subscription)
+}
 
-	// Add event to the queue
-	errUpdateSubscriptionsBatch := apiClient.QueueSubscriptions(subscriptions)
-	// Log the message
-	if errUpdateSubscriptionsBatch != nil {
-		log.Fatalf("Error while updating subscriptions in batch: %s.\n", errUpdateSubscriptionsBatch.Error())
-	} else {
-		log.Println("Updated subscriptions successfully added to the queue")
+// Update Subscriptions Batch
+func UpdateSubscriptionsBatch(subscriptions []*models.SubscriptionModel, configurationOption map[string]interface{}) error {
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		return err
 	}
+	return c.UpdateSubscriptionsBatch(subscriptions)
 }
 
 // Moesif Middleware
 func MoesifMiddleware(next http.Handler, configurationOption map[string]interface{}) http.Handler {
-	// Call the function to initialize the moesif client and moesif options
-	if apiClient == nil {
-		moesifOption = configurationOption
-		moesifClient(moesifOption)
+	// Initialize the default client on first use
+	c, err := getDefaultClient(configFromOptions(configurationOption))
+	if err != nil {
+		// serve requests without capturing them
+		return next
 	}
+	return c.Middleware(next)
+}
 
+// MoesifMiddlewareWithConfig is MoesifMiddleware for a typed Config.
+// It returns the Config.Validate error instead of a handler if config is invalid,
+// and an error if the default client conflicts with a running Client.
+func MoesifMiddlewareWithConfig(next http.Handler, config *Config) (http.Handler, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := getDefaultClient(configOf(config))
+	if err != nil {
+		return nil, err
+	}
+	return c.Middleware(next), nil
+}
+
+// Middleware wraps next to capture its API calls with this client
+func (c *Client) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, request *http.Request) {
-		// Buffer
-		var buf bytes.Buffer
+		// Bot traffic is not captured if the app config blocks it, but governance
+		// rules and IP blocks still apply to it
+		bot := c.botName(request)
+		skipBot := bot != "" && c.appConfig.Read().BlockBotTraffic
+		if skipBot && c.config.BlockBotRequests {
+			c.logger.Debug("Blocked bot traffic", "bot", bot, "direction", "Incoming")
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		logBody := c.config.LogBody && !skipBot
+
+		// Buffer for the first Max_Response_Body_Size bytes of the response
+		var respBody *captureBuffer
 
-		// Create a writer to duplicates it's writes to all the provided writers
-		multiWriter := io.MultiWriter(rw, &buf)
+		// Create a writer to duplicates it's writes to all the provided writers,
+		// writing straight through when the body is not logged
+		var writer io.Writer = rw
+		if logBody {
+			respBody = &captureBuffer{max: c.config.MaxResponseBodySize}
+			writer = io.MultiWriter(rw, respBody)
+		}
 
 		// Initialize the status to 200 in case WriteHeader is not called
 		response := responseRecorder(
 			rw,
 			200,
-			multiWriter,
+			writer,
 		)
 
 		// Add transactionId to the headers
-		if !disableTransactionId {
+		if !c.config.DisableTransactionId {
 			// Try to fetch the transactionId from the header
 			transactionId := request.Header.Get("X-Moesif-Transaction-Id")
 			// Check if need to generate transactionId
@@ -308,32 +354,68 @@ func MoesifMiddleware(next http.Handler, configurationOption map[string]interfac
 
 		// Request Time
 		requestTime := time.Now().UTC()
-		var body1, body2 io.ReadCloser
-		var err error
-		if logBody {
-			// buffer the entire request body into memory for logging
-			if body1, body2, err = teeBody(request.Body); err != nil {
-				log.Printf("Error while reading request body: %v.\n", err)
+		var reqBody *captureBuffer
+		if logBody && c.config.StreamRequestBody && request.Body != nil && request.Body != http.NoBody {
+			// capture the request body as the handler reads it, keeping the first
+			// Max_Request_Body_Size bytes for logging
+			reqBody = &captureBuffer{max: c.config.MaxRequestBodySize}
+			request.Body = readCloser{io.TeeReader(request.Body, reqBody), request.Body}
+		} else if logBody && request.Body != nil && request.Body != http.NoBody {
+			// buffer the first Max_Request_Body_Size bytes of the request body into memory for logging
+			body, captured, err := captureBody(request.Body, c.config.MaxRequestBodySize)
+			if err != nil {
+				c.logger.Error("Error while reading request body", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "error", err)
 			} else {
 				// Body is a ReadCloser meaning that it does not implement the Seek interface
-				// It must be buffered into memory to be read more than once
-				// This is a replacement reader reading the buffer for the original server handler
-				request.Body = body1
+				// The buffered bytes are read again by the original server handler,
+				// followed by the rest of the body
+				request.Body = readCloser{body, request.Body}
+				reqBody = captured
 			}
 		}
 
-		companyId := getConfigStringValuesForIncomingEvent("Identify_Company", request, response)
-		userId := getConfigStringValuesForIncomingEvent("Identify_User", request, response)
+		companyId := getConfigStringValuesForIncomingEvent(c.config.IdentifyCompany, request, response)
+		userId := getConfigStringValuesForIncomingEvent(c.config.IdentifyUser, request, response)
 		// get user / company cohort rules' individual user and company entities info
 		// this is used to associate these entities with a speicifc rule and provide individual
 		// entity fields for header and body templating in the rule
-		userValues, companyValues := appConfig.GetEntityValues(userId, companyId)
+		userValues, companyValues := c.appConfig.GetEntityValues(userId, companyId)
 		// get rule records for cohort members above as well as regexp rules and check all rule matches
-		rules := governanceRules.Get(request, userValues, companyValues, userId, companyId)
-		ro := NewResponseOverride(&response, rules)
+		// body conditions read at most Max_Request_Body_Size bytes of the body, once
+		lookup := newRuleLookup(request, c.config.MaxRequestBodySize, c.logger)
+		rules := c.governanceRules.get(lookup, userValues, companyValues, userId, companyId)
+		// the event is sampled after the handler has read the body, so regex
+		// sampling rules with body conditions need it read now
+		if c.appConfig.samplesByBody() {
+			lookup.requestBody()
+		}
+		applied, shadowed := c.splitShadowRules(rules)
+		for _, r := range applied {
+			c.logger.Debug("Governance rule matched", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "rule_id", r.Rule.ID, "block", r.Rule.Block)
+		}
+		for _, r := range shadowed {
+			c.logger.Debug("Governance rule matched in shadow mode", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "rule_id", r.Rule.ID, "block", r.Rule.Block)
+		}
+		ro := NewResponseOverride(&response, applied)
+
+		// Record how the request was captured
+		captureInfo := make(map[string]interface{})
+		if bot != "" {
+			captureInfo["bot"] = bot
+		}
+		c.recordShadowRules(request, shadowed, captureInfo)
+
+		// Requests from addresses blocked by the app config get the Blocked_IP_Response
+		// in place of any governance rule override
+		ip := c.blockingIP(request)
+		if name, blocked := c.appConfig.BlockedIP(ip); blocked {
+			c.logger.Debug("Blocked request from IP address", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "ip_address", ip, "name", name)
+			ro.Override = c.blockedIPOverride()
+			captureInfo["blocked"] = map[string]interface{}{"reason": "ip_address", "ip_address": ip, "name": name}
+		}
 		if !ro.Override.Block {
 			// Serve the HTTP Request
-			next.ServeHTTP(&ro, request)
+			next.ServeHTTP(withInterfacesOf(&ro, rw), request)
 		}
 		ro.finish()
 
@@ -341,62 +423,51 @@ func MoesifMiddleware(next http.Handler, configurationOption map[string]interfac
 		responseTime := time.Now().UTC()
 
 		shouldSkip := false
-		if _, found := moesifOption["Should_Skip"]; found {
-			shouldSkip = moesifOption["Should_Skip"].(func(*http.Request, MoesifResponseRecorder) bool)(request, response)
+		if c.config.ShouldSkip != nil {
+			shouldSkip = c.config.ShouldSkip(request, response)
 		}
 
-		if shouldSkip {
-			if debug {
-				log.Printf("Skip sending the event to Moesif")
-			}
+		if skipBot {
+			c.logger.Debug("Skip capturing bot traffic", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "bot", bot, "direction", "Incoming")
+		} else if shouldSkip {
+			c.logger.Debug("Skip sending the event to Moesif", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "direction", "Incoming")
 		} else {
-			if debug {
-				log.Printf("Sending the event to Moesif")
-			}
-			if logBody {
-				// this is a separate ReadCloser, reading the same buffer as above for logging
-				request.Body = body2
-			}
+			c.logger.Debug("Sending the event to Moesif", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "direction", "Incoming")
 			// Call the function to send event to Moesif
-			sendEvent(request, response, buf.String(), requestTime, responseTime)
+			c.sendEvent(request, lookup, response, reqBody, respBody, requestTime, responseTime, captureInfo)
 		}
 	})
 }
 
 // Sending event to Moesif
-func sendEvent(request *http.Request, response MoesifResponseRecorder, rspBufferString string, reqTime time.Time, rspTime time.Time) {
+// reqBody and respBody hold the captured bodies, and are nil if bodies are not logged
+// captureInfo holds what the middleware recorded about the request, such as its bot classification
+// lookup holds the request values the governance rules matched, for the regex sampling rules
+func (c *Client) sendEvent(request *http.Request, lookup *ruleLookup, response MoesifResponseRecorder, reqBody, respBody *captureBuffer, reqTime time.Time, rspTime time.Time, captureInfo map[string]interface{}) error {
 	// Get Api Version
 	var apiVersion *string = nil
-	if isApiVersion, found := moesifOption["Api_Version"].(string); found {
-		apiVersion = &isApiVersion
+	if c.config.ApiVersion != "" {
+		apiVersion = &c.config.ApiVersion
 	}
 
 	// Get Request Body
-	var reqBody interface{}
+	var reqBodyParsed interface{}
 	var reqEncoding string
-	readReqBody, reqBodyErr := ioutil.ReadAll(request.Body)
-	if reqBodyErr != nil {
-		if debug {
-			log.Printf("Error while reading request body: %s.\n", reqBodyErr.Error())
-		}
-	}
-	reqContentLength := getContentLength(request.Header, readReqBody)
+	reqContentLength := c.getContentLength(request.Header, bodySize(reqBody, request.ContentLength))
 
 	// Check if the request body is empty
-	reqBody = nil
-	if logBody && (len(readReqBody)) > 0 {
-		reqBody, reqEncoding = parseBody(readReqBody, "Request_Body_Masks")
+	if len(reqBody.bytes()) > 0 {
+		reqBodyParsed, reqEncoding = c.parseEncodedBody(reqBody.bytes(), reqBody.truncated(request.ContentLength), request.Header, c.config.MaxRequestBodySize, c.config.RequestBodyMasks, captureInfo, "request")
 	}
 
 	// Get the response body
-	var respBody interface{}
+	var respBodyParsed interface{}
 	var respEncoding string
-	respContentLength := getContentLength(response.Header(), []byte(rspBufferString))
+	respContentLength := c.getContentLength(response.Header(), bodySize(respBody, -1))
 
 	// Parse the response Body
-	respBody = nil
-	if logBody {
-		respBody, respEncoding = parseBody([]byte(rspBufferString), "Response_Body_Masks")
+	if respBody != nil {
+		respBodyParsed, respEncoding = c.parseEncodedBody(respBody.bytes(), respBody.truncated(-1), response.Header(), c.config.MaxResponseBodySize, c.config.ResponseBodyMasks, captureInfo, "response")
 	}
 
 	// Get URL Scheme
@@ -406,49 +477,47 @@ func sendEvent(request *http.Request, response MoesifResponseRecorder, rspBuffer
 
 	// Get Metadata
 	var metadata map[string]interface{} = nil
-	if _, found := moesifOption["Get_Metadata"]; found {
-		metadata = moesifOption["Get_Metadata"].(func(*http.Request, MoesifResponseRecorder) map[string]interface{})(request, response)
+	if c.config.GetMetadata != nil {
+		metadata = c.config.GetMetadata(request, response)
+	}
+
+	// Record how the response was written
+	if response.streamed {
+		captureInfo["streamed"] = true
+	}
+	if response.hijacked {
+		captureInfo["hijacked"] = true
+	}
+	var tags *string
+	if _, bot := captureInfo["bot"]; bot {
+		tag := botTag
+		tags = &tag
 	}
+	addTruncation(captureInfo, "request", reqBody, request.ContentLength)
+	addTruncation(captureInfo, "response", respBody, -1)
+	metadata = addCaptureMetadata(metadata, captureInfo)
 
 	// Get User
-	userId := getConfigStringValuesForIncomingEvent("Identify_User", request, response)
+	userId := getConfigStringValuesForIncomingEvent(c.config.IdentifyUser, request, response)
 
 	// Get Company
-	companyId := getConfigStringValuesForIncomingEvent("Identify_Company", request, response)
+	companyId := getConfigStringValuesForIncomingEvent(c.config.IdentifyCompany, request, response)
 
 	// Get Session Token
-	sessionToken := getConfigStringValuesForIncomingEvent("Get_Session_Token", request, response)
+	sessionToken := getConfigStringValuesForIncomingEvent(c.config.GetSessionToken, request, response)
 
 	direction := "Incoming"
 
 	// Mask Request Header
 	var requestHeader map[string]interface{}
-	requestHeader = maskHeaders(HeaderToMap(request.Header), "Request_Header_Masks")
+	requestHeader = c.maskHeaders(HeaderToMap(request.Header), c.config.RequestHeaderMasks)
 
 	// Mask Response Header
 	var responseHeader map[string]interface{}
-	responseHeader = maskHeaders(HeaderToMap(response.Header()), "Response_Header_Masks")
+	responseHeader = c.maskHeaders(HeaderToMap(response.Header()), c.config.ResponseHeaderMasks)
 
 	// Send Event To Moesif
-	sendMoesifAsync(request, reqTime, requestHeader, apiVersion, reqBody, &reqEncoding, reqContentLength, 
-		rspTime, response.status, responseHeader, respBody, &respEncoding, respContentLength, 
-		userId, companyId, &sessionToken, metadata, &direction)
-}
-
-// teeBody reads all of b to memory and then returns two equivalent
-// ReadClosers yielding the same bytes.
-// It returns an error if the initial slurp of all bytes fails.
-func teeBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
-	if b == nil || b == http.NoBody {
-		// No copying needed
-		return http.NoBody, http.NoBody, nil
-	}
-	var buf bytes.Buffer
-	if _, err = buf.ReadFrom(b); err != nil {
-		return nil, b, err
-	}
-	if err = b.Close(); err != nil {
-		return nil, b, err
-	}
-	return ioutil.NopCloser(&buf), ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	return c.sendMoesifAsync(request, lookup, reqTime, requestHeader, apiVersion, reqBodyParsed, &reqEncoding, reqContentLength,
+		rspTime, response.status, responseHeader, respBodyParsed, &respEncoding, respContentLength,
+		userId, companyId, &sessionToken, tags, metadata, &direction)
 }
@@ -0,0 +1,246 @@
+package moesifmiddleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moesif/moesifapi-go/models"
+)
+
+// waitForEvents polls api until it has n events or a second has passed
+func waitForEvents(api *fakeAPI, n int) []*models.EventModel {
+	deadline := time.Now().Add(time.Second)
+	for len(api.Events()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return api.Events()
+}
+
+func captureInfo(e *models.EventModel) map[string]interface{} {
+	metadata, _ := e.Metadata.(map[string]interface{})
+	info, _ := metadata[captureMetadataKey].(map[string]interface{})
+	return info
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	config := NewConfig("app")
+	config.GetMetadata = func(*http.Request, MoesifResponseRecorder) map[string]interface{} {
+		return map[string]interface{}{"tenant": "a"}
+	}
+	c, api := newTestClient(config)
+	handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("data: 1\n\n"))
+		rw.(http.Flusher).Flush()
+		rw.Write([]byte("data: 2\n\n"))
+	}))
+	request := httptest.NewRequest("GET", "/events", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if !response.Flushed || response.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("expected a flushed response, got flushed=%v body=%q", response.Flushed, response.Body.String())
+	}
+	events := api.Events()
+	if len(events) != 1 || captureInfo(events[0])["streamed"] != true {
+		t.Fatalf("expected the event to be marked streamed, got %#v", events)
+	}
+	if events[0].Metadata.(map[string]interface{})["tenant"] != "a" {
+		t.Errorf("Get_Metadata values should be kept")
+	}
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	c, api := newTestClient(NewConfig("app"))
+	server := httptest.NewServer(c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+	status, _ := bufio.NewReader(conn).ReadString('\n')
+	if !strings.Contains(status, "101") {
+		t.Errorf("expected 101 from the hijacked connection, got %q", status)
+	}
+
+	events := waitForEvents(api, 1)
+	if len(events) != 1 || captureInfo(events[0])["hijacked"] != true {
+		t.Fatalf("expected the event to be marked hijacked, got %#v", events)
+	}
+}
+
+func TestMiddlewareUnsupportedInterfaces(t *testing.T) {
+	c, _ := newTestClient(NewConfig("app"))
+	handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// httptest.ResponseRecorder is a Flusher, but not a Hijacker or Pusher
+		if _, ok := rw.(http.Hijacker); ok {
+			t.Error("the writer should not be a Hijacker")
+		}
+		if _, ok := rw.(http.Pusher); ok {
+			t.Error("the writer should not be a Pusher")
+		}
+		if _, ok := rw.(http.Flusher); !ok {
+			t.Error("the writer should be a Flusher")
+		}
+		if _, ok := rw.(interface{ Unwrap() http.ResponseWriter }); !ok {
+			t.Error("expected Unwrap for http.ResponseController")
+		}
+		io.Copy(rw, strings.NewReader("copied"))
+	}))
+	response := serve(handler, "GET", "/", "")
+	if response.Body.String() != "copied" {
+		t.Errorf("expected ReadFrom to write the body, got %q", response.Body.String())
+	}
+}
+
+// plainWriter is a ResponseWriter without any optional interface
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestMiddlewarePlainWriter(t *testing.T) {
+	c, api := newTestClient(NewConfig("app"))
+	handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if _, ok := rw.(http.Flusher); ok {
+			t.Error("the writer should not be a Flusher")
+		}
+		if _, ok := rw.(http.Hijacker); ok {
+			t.Error("the writer should not be a Hijacker")
+		}
+		rw.Write([]byte("plain"))
+	}))
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(plainWriter{response}, httptest.NewRequest("GET", "/", nil))
+	if response.Body.String() != "plain" {
+		t.Errorf("got %q", response.Body.String())
+	}
+	if events := api.Events(); len(events) != 1 || captureInfo(events[0])["streamed"] != nil {
+		t.Errorf("expected one event that is not streamed, got %#v", events)
+	}
+}
+
+func TestMiddlewareMaxBodySize(t *testing.T) {
+	config := NewConfig("app")
+	config.MaxRequestBodySize = 4
+	config.MaxResponseBodySize = 6
+	c, api := newTestClient(config)
+
+	request := httptest.NewRequest("POST", "/items", strings.NewReader(`{"name":"abcdefgh"}`))
+	request.ContentLength = -1
+	response := httptest.NewRecorder()
+	c.Middleware(echo).ServeHTTP(response, request)
+	if response.Body.String() != `{"name":"abcdefgh"}` {
+		t.Errorf("handler did not see the whole request body, got %q", response.Body.String())
+	}
+
+	events := api.Events()
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	e := events[0]
+	// truncated JSON cannot be parsed and masked, so it is not logged
+	if (e.Request.Body != nil && *e.Request.Body != nil) || e.Response.Body != nil {
+		t.Errorf("expected no truncated bodies, got %v and %v", e.Request.Body, e.Response.Body)
+	}
+	if *e.Request.ContentLength != 19 || *e.Response.ContentLength != 19 {
+		t.Errorf("expected the original sizes as content length, got %d and %d", *e.Request.ContentLength, *e.Response.ContentLength)
+	}
+	expected := map[string]interface{}{
+		"request_body_truncated":  true,
+		"request_body_size":       int64(19),
+		"response_body_truncated": true,
+		"response_body_size":      int64(19),
+	}
+	if info := captureInfo(e); !reflect.DeepEqual(info, expected) {
+		t.Errorf("got capture metadata %v, expected %v", info, expected)
+	}
+}
+
+func TestMiddlewareTruncatedBodyIsNotSentUnmasked(t *testing.T) {
+	config := NewConfig("app")
+	config.MaxRequestBodySize = 40
+	config.RequestBodyMasks = func() []string { return []string{"password"} }
+	c, api := newTestClient(config)
+	serve(c.Middleware(echo), "POST", "/login", `{"password":"hunter2-secret","padding":"`+strings.Repeat("x", 64)+`"}`)
+
+	e := api.Events()[0]
+	if e.Request.Body != nil && *e.Request.Body != nil {
+		t.Errorf("expected no request body, got %v", *e.Request.Body)
+	}
+	if info := captureInfo(e); info["request_body_truncated"] != true {
+		t.Errorf("expected the body to be marked truncated, got %v", info)
+	}
+}
+
+func TestMiddlewareBodyWithinMaxSize(t *testing.T) {
+	config := NewConfig("app")
+	config.MaxRequestBodySize = 64
+	config.MaxResponseBodySize = 64
+	c, api := newTestClient(config)
+	serve(c.Middleware(echo), "POST", "/items", `{"name":"a"}`)
+
+	e := api.Events()[0]
+	if body, ok := e.Response.Body.(map[string]interface{}); !ok || body["name"] != "a" {
+		t.Errorf("expected the whole response body, got %v", e.Response.Body)
+	}
+	if info := captureInfo(e); info != nil {
+		t.Errorf("expected no capture metadata, got %v", info)
+	}
+}
+
+func TestMiddlewareStreamRequestBody(t *testing.T) {
+	config := NewConfig("app")
+	config.StreamRequestBody = true
+	c, api := newTestClient(config)
+
+	// the handler reads the first chunk before the client sends the rest
+	body, upload := io.Pipe()
+	firstChunk := make(chan struct{})
+	handler := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p := make([]byte, 6)
+		if _, err := io.ReadFull(r.Body, p); err != nil || string(p) != `{"a":1` {
+			t.Errorf("expected the first chunk, got %q %v", p, err)
+		}
+		close(firstChunk)
+	}))
+	go func() {
+		io.WriteString(upload, `{"a":1`)
+		select {
+		case <-firstChunk:
+		case <-time.After(time.Second):
+			t.Error("handler did not see the first chunk before the body was complete")
+		}
+		io.WriteString(upload, `,"b":2}`)
+		upload.Close()
+	}()
+	request := httptest.NewRequest("POST", "/upload", body)
+	request.ContentLength = 13
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	body.Close()
+
+	e := api.Events()[0]
+	if e.Request.Body != nil && *e.Request.Body != nil {
+		t.Errorf("expected no body for the partly read JSON, got %v", *e.Request.Body)
+	}
+	if info := captureInfo(e); info["request_body_truncated"] != true || info["request_body_size"] != int64(13) {
+		t.Errorf("expected the unread body to be marked truncated, got %v", info)
+	}
+}
@@ -0,0 +1,200 @@
+package moesifmiddleware
+
+import (
+	b64 "encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// PIIDetectorNames lists the built-in PII detectors for the PII_Detectors option
+var PIIDetectorNames = []string{"credit_card", "email", "phone", "ssn", "jwt", "aws_key"}
+
+// piiDetector finds one kind of PII. If valid is set, matches it rejects are
+// not redacted. If group is set, only that submatch of a match is redacted.
+type piiDetector struct {
+	pattern *regexp.Regexp
+	valid   func(string) bool
+	group   int
+}
+
+// piiDetectors are the built-in detectors, applied in PIIDetectorNames order
+var piiDetectors = map[string]piiDetector{
+	"credit_card": {
+		pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		valid:   luhnValid,
+	},
+	"email": {
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	"phone": {
+		// a bare run of ten digits is more often an id or a timestamp, so numbers
+		// need a country code, an area code in parentheses, or separators
+		pattern: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?(?:\(\d{3}\)[ .-]?|\d{3}[ .-]?)\d{3}[ .-]?\d{4}|\(\d{3}\)[ .-]?\d{3}[ .-]?\d{4}|\b\d{3}[ .-]\d{3}[ .-]\d{4})\b`),
+	},
+	"ssn": {
+		pattern: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		valid:   ssnValid,
+	},
+	"jwt": {
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	},
+	"aws_key": {
+		// access key ids, and secret access keys where they are labeled as such
+		pattern: regexp.MustCompile(`\b(?:A3T[A-Z0-9]|AKIA|ASIA|AGPA|AIDA|AROA|AIPA|ANPA|ANVA)[A-Z0-9]{16}\b|(?i:aws_?secret_?(?:access_?)?key)["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`),
+		group:   1,
+	},
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ssnValid rejects numbers that are never issued as US Social Security Numbers
+func ssnValid(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// piiScrubber redacts the PII found by its detectors. A nil piiScrubber redacts nothing.
+type piiScrubber struct {
+	detectors []piiDetector
+}
+
+// newPIIScrubber returns a piiScrubber for the PII_Detectors and PII_Patterns
+// options, or nil if neither is set. Unknown detector names are ignored, since
+// Validate reports them.
+func newPIIScrubber(config *Config) *piiScrubber {
+	var detectors []piiDetector
+	for _, name := range PIIDetectorNames {
+		if contains(config.PIIDetectors, name) {
+			detectors = append(detectors, piiDetectors[name])
+		}
+	}
+	for _, pattern := range config.PIIPatterns {
+		if pattern != nil {
+			detectors = append(detectors, piiDetector{pattern: pattern})
+		}
+	}
+	if len(detectors) == 0 {
+		return nil
+	}
+	return &piiScrubber{detectors: detectors}
+}
+
+// scrub returns s with the PII found by each detector replaced by "*****"
+func (s *piiScrubber) scrub(text string) string {
+	if s == nil {
+		return text
+	}
+	for _, d := range s.detectors {
+		text = d.redact(text)
+	}
+	return text
+}
+
+func (d piiDetector) redact(text string) string {
+	matches := d.pattern.FindAllStringSubmatchIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if d.group > 0 && m[2*d.group] >= 0 {
+			start, end = m[2*d.group], m[2*d.group+1]
+		}
+		if d.valid != nil && !d.valid(text[start:end]) {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString("*****")
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// scrubValue scrubs the strings in a parsed body or header map
+func (s *piiScrubber) scrubValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		return s.scrub(v)
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = s.scrubValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = s.scrubValue(child)
+		}
+	case records:
+		s.scrubValue([]interface{}(v))
+	case []string:
+		scrubbed := make([]string, len(v))
+		for i, child := range v {
+			scrubbed[i] = s.scrub(child)
+		}
+		return scrubbed
+	}
+	return val
+}
+
+// scrubBody scrubs a parsed body, or a base64 body that decodes to text
+func (s *piiScrubber) scrubBody(body interface{}, encoding string) interface{} {
+	if s == nil || body == nil {
+		return body
+	}
+	if encoding != "base64" {
+		return s.scrubValue(body)
+	}
+	encoded, _ := body.(string)
+	decoded, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil || !utf8.Valid(decoded) {
+		return body
+	}
+	if scrubbed := s.scrub(string(decoded)); scrubbed != string(decoded) {
+		return b64.StdEncoding.EncodeToString([]byte(scrubbed))
+	}
+	return body
+}
+
+// scrubURI scrubs a URI path and each value in its query string
+func (s *piiScrubber) scrubURI(path, rawQuery string) (string, string) {
+	if s == nil {
+		return path, rawQuery
+	}
+	path = s.scrub(path)
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		eq := strings.IndexByte(param, '=')
+		if eq < 0 {
+			continue
+		}
+		value, err := url.QueryUnescape(param[eq+1:])
+		if err != nil {
+			value = param[eq+1:]
+		}
+		if scrubbed := s.scrub(value); scrubbed != value {
+			params[i] = param[:eq+1] + strings.ReplaceAll(url.QueryEscape(scrubbed), "%2A", "*")
+		}
+	}
+	return path, strings.Join(params, "&")
+}
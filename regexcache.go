@@ -0,0 +1,57 @@
+package moesifmiddleware
+
+import (
+	"regexp"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+// regexCache holds the compiled regular expressions of rule conditions, keyed
+// by pattern. Invalid patterns are kept as nil so they are reported only once,
+// when the rules load.
+type regexCache map[string]*regexp.Regexp
+
+// compile adds pattern to the cache, returning the error if it is invalid
+func (c regexCache) compile(pattern string) error {
+	if _, ok := c[pattern]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	c[pattern] = re
+	return err
+}
+
+// match reports whether s matches pattern. Patterns missing from the cache are
+// compiled for this call only, and invalid patterns never match.
+func (c regexCache) match(pattern, s string) (bool, error) {
+	if re, ok := c[pattern]; ok {
+		return re != nil && re.MatchString(s), nil
+	}
+	return regexp.MatchString(pattern, s)
+}
+
+// compileGovernanceRules compiles the condition patterns of rules, logging each
+// rule with an invalid pattern
+func compileGovernanceRules(c regexCache, rules []moesifapi.GovernanceRule, logger Logger) {
+	for _, rule := range rules {
+		for _, regexAnd := range rule.RegexConfigOr {
+			for _, cond := range regexAnd.Conditions {
+				if err := c.compile(cond.Value); err != nil {
+					logger.Error("Governance rule regexp error, the condition will never match", "org_id", rule.OrgID, "app_id", rule.AppID, "rule_id", rule.ID, "rule_name", rule.Name, "path", cond.Path, "regexp", cond.Value, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// compileSamplingRules compiles the condition patterns of regex sampling rules,
+// logging each rule with an invalid pattern
+func compileSamplingRules(c regexCache, rules []RegexRule, logger Logger) {
+	for i, rule := range rules {
+		for _, cond := range rule.Conditions {
+			if err := c.compile(cond.Value); err != nil {
+				logger.Error("Sampling rule regexp error, the condition will never match", "rule", i, "path", cond.Path, "regexp", cond.Value, "error", err)
+			}
+		}
+	}
+}
@@ -1,27 +1,54 @@
 package moesifmiddleware
 
 import (
-	"log"
 	"math/rand"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/moesif/moesifapi-go/models"
 )
 
+// captureMetadataKey is the event metadata key under which the middleware
+// records how an event was captured
+const captureMetadataKey = "_moesif"
+
+// addCaptureMetadata returns metadata with info added under captureMetadataKey,
+// copying metadata so that the map returned by Get_Metadata is not modified
+func addCaptureMetadata(metadata map[string]interface{}, info map[string]interface{}) map[string]interface{} {
+	if len(info) == 0 {
+		return metadata
+	}
+	merged := make(map[string]interface{}, len(metadata)+1)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged[captureMetadataKey] = info
+	return merged
+}
+
 // Send Event to Moesif
-func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[string]interface{}, apiVersion *string, reqBody interface{}, reqEncoding *string, reqContentLength *int64,
+// Errors adding the event to the queue are passed to reportError and returned
+// lookup looks up the request values regex sampling rules match
+func (c *Client) sendMoesifAsync(request *http.Request, lookup *ruleLookup, reqTime time.Time, reqHeader map[string]interface{}, apiVersion *string, reqBody interface{}, reqEncoding *string, reqContentLength *int64,
 	rspTime time.Time, respStatus int, respHeader map[string]interface{}, respBody interface{}, respEncoding *string, respContentLength *int64,
-	userId string, companyId string, sessionToken *string, metadata map[string]interface{},
-	direction *string) {
+	userId string, companyId string, sessionToken *string, tags *string, metadata map[string]interface{},
+	direction *string) error {
 
 	// Get Client Ip
 	ip := getClientIp(request)
 
-	uri := request.URL.Scheme + "://" + request.Host + request.URL.Path
-	if request.URL.RawQuery != "" {
-		uri += "?" + request.URL.RawQuery
+	// Mask the URI, then redact PII from it and from the headers and bodies
+	path, rawQuery := c.pii.scrubURI(c.maskPath(request.URL.Path), c.maskQuery(request.URL.RawQuery))
+	if c.pii != nil {
+		reqHeader = c.pii.scrubValue(reqHeader).(map[string]interface{})
+		respHeader = c.pii.scrubValue(respHeader).(map[string]interface{})
+		reqBody = c.pii.scrubBody(reqBody, *reqEncoding)
+		respBody = c.pii.scrubBody(respBody, *respEncoding)
+	}
+
+	uri := request.URL.Scheme + "://" + request.Host + path
+	if rawQuery != "" {
+		uri += "?" + rawQuery
 	}
 
 	// Prepare request model
@@ -53,7 +80,7 @@ func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[str
 	randomPercentage := rand.Intn(100)
 
 	// Parse sampling percentage based on user/company
-	samplingPercentage := getSamplingPercentage(userId, companyId)
+	samplingPercentage := c.appConfig.getSamplingPercentage(lookup, userId, companyId)
 
 	if samplingPercentage > randomPercentage {
 
@@ -70,7 +97,7 @@ func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[str
 			Request:      event_request,
 			Response:     event_response,
 			SessionToken: sessionToken,
-			Tags:         nil,
+			Tags:         tags,
 			UserId:       &userId,
 			CompanyId:    &companyId,
 			Metadata:     metadata,
@@ -78,17 +105,15 @@ func sendMoesifAsync(request *http.Request, reqTime time.Time, reqHeader map[str
 			Weight:       &eventWeight,
 		}
 
-		errSendEvent := apiClient.QueueEvent(&event)
+		errSendEvent := c.queue(1, func() error { return c.api.QueueEvent(&event) })
 		if errSendEvent != nil {
-			log.Fatalf("Error while adding event to Moesif: %s.\n", errSendEvent.Error())
-		} else {
-			if debug {
-				log.Println("Event successfully added to the queue")
-			}
+			c.reportError(errSendEvent)
+			return errSendEvent
 		}
+		c.logger.Debug("Event successfully added to the queue", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "direction", *direction)
 	} else {
-		if debug {
-			log.Println("Skipped Event due to sampling percentage: " + strconv.Itoa(samplingPercentage) + " and random percentage: " + strconv.Itoa(randomPercentage))
-		}
+		c.logger.Debug("Skipped event due to sampling", "transaction_id", request.Header.Get("X-Moesif-Transaction-Id"), "direction", *direction,
+			"sampling_percentage", samplingPercentage, "random_percentage", randomPercentage)
 	}
+	return nil
 }
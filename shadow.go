@@ -0,0 +1,42 @@
+package moesifmiddleware
+
+import "net/http"
+
+// splitShadowRules separates the matching rules whose overrides are applied
+// from those in shadow mode, through the Governance_Shadow_Mode or
+// Shadow_Rule_Ids options, which are only recorded
+func (c *Client) splitShadowRules(rules []RuleTemplate) (applied, shadowed []RuleTemplate) {
+	for _, r := range rules {
+		if c.config.GovernanceShadowMode || contains(c.config.ShadowRuleIds, r.Rule.ID) {
+			shadowed = append(shadowed, r)
+		} else {
+			applied = append(applied, r)
+		}
+	}
+	return
+}
+
+// recordShadowRules adds the shadowed rules to captureInfo, with whether each
+// would have blocked the request and the status it would have set, and passes
+// them to the On_Shadow_Rule_Match callback
+func (c *Client) recordShadowRules(request *http.Request, shadowed []RuleTemplate, captureInfo map[string]interface{}) {
+	if len(shadowed) == 0 {
+		return
+	}
+	info := make([]interface{}, len(shadowed))
+	for i, r := range shadowed {
+		rule := map[string]interface{}{
+			"rule_id":   r.Rule.ID,
+			"rule_name": r.Rule.Name,
+			"block":     r.Rule.Block,
+		}
+		if status := r.Rule.ResponseOverrides.Status; status != 0 {
+			rule["status"] = status
+		}
+		info[i] = rule
+	}
+	captureInfo["shadow_rules"] = info
+	if c.config.OnShadowRuleMatch != nil {
+		c.config.OnShadowRuleMatch(request, shadowed)
+	}
+}
@@ -0,0 +1,82 @@
+package moesifmiddleware
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/moesif/moesifapi-go"
+)
+
+func TestGovernanceShadowMode(t *testing.T) {
+	block := ruleWith("request.route", "^/items")
+	block.ID = "block"
+	block.Name = "Block items"
+	block.Block = true
+	block.ResponseOverrides = moesifapi.ResponseOverrides{Status: http.StatusTooManyRequests, Body: `{"error":"blocked"}`}
+	header := ruleWith("request.verb", "^GET$")
+	header.ID = "header"
+	header.ResponseOverrides = moesifapi.ResponseOverrides{Headers: map[string]string{"X-Rule": "applied"}}
+
+	tests := []struct {
+		name      string
+		global    bool
+		ruleIds   []string
+		status    int
+		header    string
+		shadowIds []string
+	}{
+		{"rules applied", false, nil, http.StatusTooManyRequests, "applied", nil},
+		{"global shadow mode", true, nil, http.StatusOK, "", []string{"block", "header"}},
+		{"shadow one rule", false, []string{"block"}, http.StatusOK, "applied", []string{"block"}},
+	}
+	for _, test := range tests {
+		config := NewConfig("app")
+		config.GovernanceShadowMode = test.global
+		config.ShadowRuleIds = test.ruleIds
+		var called []string
+		config.OnShadowRuleMatch = func(r *http.Request, rules []RuleTemplate) {
+			for _, rule := range rules {
+				called = append(called, rule.Rule.ID)
+			}
+		}
+		c, api := newTestClient(config)
+		rules := NewGovernanceRulesConfig()
+		rules.Regex = []moesifapi.GovernanceRule{block, header}
+		c.governanceRules.Write(rules)
+
+		response := serve(c.Middleware(echo), "GET", "/items", "")
+		if response.Code != test.status || response.Header().Get("X-Rule") != test.header {
+			t.Errorf("%s: got status %d and X-Rule %q", test.name, response.Code, response.Header().Get("X-Rule"))
+		}
+
+		events := api.Events()
+		if len(events) != 1 {
+			t.Fatalf("%s: expected one event, got %d", test.name, len(events))
+		}
+		var recorded []string
+		shadowRules, _ := captureInfo(events[0])["shadow_rules"].([]interface{})
+		for _, r := range shadowRules {
+			rule := r.(map[string]interface{})
+			recorded = append(recorded, rule["rule_id"].(string))
+			if rule["rule_id"] == "block" && (rule["block"] != true || rule["status"] != http.StatusTooManyRequests || rule["rule_name"] != "Block items") {
+				t.Errorf("%s: got shadow rule %v", test.name, rule)
+			}
+		}
+		if !equalIds(recorded, test.shadowIds) || !equalIds(called, test.shadowIds) {
+			t.Errorf("%s: recorded %v and called back with %v, expected %v", test.name, recorded, called, test.shadowIds)
+		}
+	}
+}
+
+// equalIds compares rule ids ignoring order
+func equalIds(a, b []string) bool {
+	set := func(ids []string) map[string]bool {
+		m := make(map[string]bool)
+		for _, id := range ids {
+			m[id] = true
+		}
+		return m
+	}
+	return len(a) == len(b) && reflect.DeepEqual(set(a), set(b))
+}